@@ -0,0 +1,204 @@
+// Package exif reads, edits and writes EXIF metadata as found in JPEG APP1 segments.
+//
+// Tags of IFD0, Exif, GPS, Interop and IFD1 (thumbnail) directories are decoded into
+// typed values. Offsets pointing to sub-directories and the thumbnail are managed by
+// the package, and are not visible as tags. Maker notes are kept as opaque blobs,
+// and written back at their original offset, as most of them contain absolute offsets.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ezdiy/image/util"
+	"io"
+)
+
+// Dir identifies one of the directories (IFDs) of EXIF data.
+type Dir int
+
+const (
+	IFD0       Dir = iota // Main image
+	ExifIFD               // Capture details
+	GPSIFD                // Location
+	InteropIFD            // Interoperability
+	IFD1                  // Thumbnail image
+	numDirs
+)
+
+var dirNames = [numDirs]string{"IFD0", "Exif", "GPS", "Interop", "IFD1"}
+
+func (d Dir) String() string {
+	if d < 0 || d >= numDirs {
+		return fmt.Sprintf("Dir(%d)", int(d))
+	}
+	return dirNames[d]
+}
+
+// Header preceding the TIFF structure in APP1 segment.
+var Header = []byte("Exif\x00\x00")
+
+var (
+	ErrNotFound = errors.New("exif: no EXIF data")
+	ErrFormat   = errors.New("exif: malformed data")
+	ErrTooLarge = errors.New("exif: data doesn't fit APP1 segment")
+)
+
+// Exif holds parsed EXIF directories.
+type Exif struct {
+	Order     binary.ByteOrder // Byte order used when written, big endian if nil.
+	Dirs      [numDirs][]Tag   // Tags of each directory, sorted by ID.
+	Thumbnail []byte           // JPEG thumbnail referenced by IFD1, if any.
+
+	// Where the maker note was found, so it can be written back at the same place.
+	makerNoteOff int
+}
+
+// Create empty EXIF data in the given byte order.
+func New(order binary.ByteOrder) *Exif {
+	return &Exif{Order: order}
+}
+
+type parser struct {
+	buf     []byte
+	order   binary.ByteOrder
+	visited map[uint32]bool
+}
+
+// Parse EXIF payload of APP1 segment. The payload may, or may not, start with Header.
+func Parse(b []byte) (e *Exif, err error) {
+	b = bytes.TrimPrefix(b, Header)
+	if len(b) < 8 {
+		return nil, ErrFormat
+	}
+	p := &parser{buf: b, visited: map[uint32]bool{}}
+	switch string(b[:4]) {
+	case "II*\x00":
+		p.order = binary.LittleEndian
+	case "MM\x00*":
+		p.order = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+	e = &Exif{Order: p.order}
+
+	// IFD0 links to IFD1, other directories are linked to by pointer tags.
+	next, err := p.readDir(e, IFD0, p.order.Uint32(b[4:]))
+	if err != nil {
+		return nil, err
+	}
+	if next != 0 {
+		// Broken thumbnail directory is not fatal, as the main image doesn't need it.
+		if _, err := p.readDir(e, IFD1, next); err != nil {
+			e.Dirs[IFD1] = nil
+		}
+	}
+	if err = p.readSubDir(e, IFD0, ExifIFD, tagExifIFD); err == nil {
+		if err = p.readSubDir(e, IFD0, GPSIFD, tagGPSIFD); err == nil {
+			err = p.readSubDir(e, ExifIFD, InteropIFD, tagInteropIFD)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Pull out the thumbnail blob.
+	if off, ok := e.Get(IFD1, tagThumbOffset); ok {
+		if n, ok := e.Get(IFD1, tagThumbLength); ok {
+			o, _ := off.Uint(0)
+			l, _ := n.Uint(0)
+			if o+l <= uint64(len(b)) {
+				e.Thumbnail = append([]byte(nil), b[o:o+l]...)
+			}
+		}
+	}
+	e.Delete(IFD1, tagThumbOffset)
+	e.Delete(IFD1, tagThumbLength)
+	return e, nil
+}
+
+// Follow pointer tag in dir `from`, and remove it from there.
+func (p *parser) readSubDir(e *Exif, from, to Dir, ptr uint16) error {
+	t, ok := e.Get(from, ptr)
+	if !ok {
+		return nil
+	}
+	e.Delete(from, ptr)
+	off, ok := t.Uint(0)
+	if !ok {
+		return ErrFormat
+	}
+	_, err := p.readDir(e, to, uint32(off))
+	return err
+}
+
+// Read one IFD, returning offset of the next one.
+func (p *parser) readDir(e *Exif, d Dir, off uint32) (next uint32, err error) {
+	b := p.buf
+	if p.visited[off] || uint64(off)+2 > uint64(len(b)) {
+		return 0, ErrFormat
+	}
+	p.visited[off] = true
+	n := int(p.order.Uint16(b[off:]))
+	pos := int(off) + 2
+	if pos+n*12+4 > len(b) {
+		return 0, ErrFormat
+	}
+	for i := 0; i < n; i++ {
+		ent := b[pos+i*12:][:12]
+		id := p.order.Uint16(ent)
+		typ := Type(p.order.Uint16(ent[2:]))
+		count := p.order.Uint32(ent[4:])
+		size := typ.Size()
+		if size == 0 {
+			continue // Unknown type, can't tell how big it is.
+		}
+		total := uint64(size) * uint64(count)
+		data := ent[8:12]
+		voff := uint32(0)
+		if total > 4 {
+			voff = p.order.Uint32(ent[8:])
+			if uint64(voff)+total > uint64(len(b)) {
+				continue // Points nowhere, drop it.
+			}
+			data = b[voff:]
+		}
+		t := Tag{ID: id, Type: typ, Value: decodeValue(p.order, typ, int(count), data)}
+		if d == ExifIFD && id == TagMakerNote && voff != 0 {
+			e.makerNoteOff = int(voff)
+		}
+		e.Dirs[d] = append(e.Dirs[d], t)
+	}
+	sortTags(e.Dirs[d])
+	return p.order.Uint32(b[pos+n*12:]), nil
+}
+
+// Extract EXIF from a JPEG stream. Reads the stream only up to the EXIF segment.
+func ReadJPEG(r io.Reader) (e *Exif, err error) {
+	err = ErrNotFound
+	rerr := util.ReadSegments(r, func(s util.Segment) bool {
+		if s.Marker == 0xe1 && bytes.HasPrefix(s.Data, Header) {
+			e, err = Parse(s.Data)
+			return false
+		}
+		return true
+	})
+	if rerr != nil {
+		return nil, rerr
+	}
+	return
+}
+
+// Extract the JPEG thumbnail from EXIF of a JPEG stream, without decoding the image
+// itself. Returns ErrNotFound if there is none.
+func ReadThumbnail(r io.Reader) ([]byte, error) {
+	e, err := ReadJPEG(r)
+	if err != nil {
+		return nil, err
+	}
+	if e.Thumbnail == nil {
+		return nil, ErrNotFound
+	}
+	return e.Thumbnail, nil
+}
@@ -0,0 +1,183 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func sample(order binary.ByteOrder) *Exif {
+	e := New(order)
+	must := func(err error) {
+		if err != nil {
+			panic(err)
+		}
+	}
+	must(e.Set(IFD0, Tag{TagMake, ASCII, "Camera Co."}))
+	must(e.Set(IFD0, Tag{TagOrientation, Short, []uint16{6}}))
+	must(e.Set(IFD0, Tag{TagXResolution, Rational, []Rat{{300, 1}}}))
+	must(e.Set(ExifIFD, Tag{TagDateTimeOriginal, ASCII, "2019:10:06 04:26:28"}))
+	must(e.Set(ExifIFD, Tag{TagBodySerialNumber, ASCII, "123456789"}))
+	must(e.Set(ExifIFD, Tag{TagMakerNote, Undefined, []byte("Maker\x00note with absolute offsets")}))
+	must(e.Set(ExifIFD, Tag{0x9204, SRational, []SRat{{-1, 3}}}))
+	must(e.Set(InteropIFD, Tag{0x0001, ASCII, "R98"}))
+	must(e.Set(GPSIFD, Tag{TagGPSVersionID, Byte, []byte{2, 2, 0, 0}}))
+	must(e.Set(GPSIFD, Tag{TagGPSLatitudeRef, ASCII, "N"}))
+	must(e.Set(GPSIFD, Tag{TagGPSLatitude, Rational, []Rat{{50, 1}, {5, 1}, {1234, 100}}}))
+	must(e.Set(IFD1, Tag{0x0103, Short, []uint16{6}}))
+	e.Thumbnail = []byte("\xff\xd8 pretend thumbnail \xff\xd9")
+	return e
+}
+
+func roundtrip(t *testing.T, e *Exif) *Exif {
+	b, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, Header) {
+		t.Fatal("missing header")
+	}
+	e2, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e2
+}
+
+func TestRoundtrip(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		e := sample(order)
+		e2 := roundtrip(t, e)
+		if e2.Order != order {
+			t.Fatalf("order %v != %v", e2.Order, order)
+		}
+		if !reflect.DeepEqual(e.Dirs, e2.Dirs) {
+			t.Fatalf("dirs differ:\n%+v\n%+v", e.Dirs, e2.Dirs)
+		}
+		if !bytes.Equal(e.Thumbnail, e2.Thumbnail) {
+			t.Fatal("thumbnail differs")
+		}
+		if o, _ := e2.Get(IFD0, TagOrientation); o.Count() != 1 {
+			t.Fatal("no orientation")
+		} else if v, _ := o.Uint(0); v != 6 {
+			t.Fatalf("orientation %d", v)
+		}
+		lat, _ := e2.Get(GPSIFD, TagGPSLatitude)
+		if v, ok := lat.Float(2); !ok || v != 12.34 {
+			t.Fatalf("latitude seconds %v", v)
+		}
+		bias, _ := e2.Get(ExifIFD, 0x9204)
+		if v, ok := bias.Float(0); !ok || v >= 0 {
+			t.Fatalf("exposure bias %v", v)
+		}
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var e Exif
+	if err := e.Set(IFD0, Tag{TagOrientation, Short, []uint16{3}}); err != nil {
+		t.Fatal(err)
+	}
+	e2 := roundtrip(t, &e)
+	if e2.Order != binary.BigEndian {
+		t.Fatalf("order %v", e2.Order)
+	}
+	if o, _ := e2.Get(IFD0, TagOrientation); o.Count() != 1 {
+		t.Fatal("no orientation")
+	}
+	roundtrip(t, &Exif{})
+}
+
+func TestStrip(t *testing.T) {
+	e := roundtrip(t, sample(binary.BigEndian))
+	mnOff := e.makerNoteOff
+	if mnOff == 0 {
+		t.Fatal("maker note offset not recorded")
+	}
+	e.StripGPS()
+	e.StripSerials()
+	// Grow IFD0 a lot, so that the data would normally overlap the maker note.
+	if err := e.Set(IFD0, Tag{TagCopyright, ASCII, string(bytes.Repeat([]byte("x"), 500))}); err != nil {
+		t.Fatal(err)
+	}
+	e2 := roundtrip(t, e)
+	if len(e2.Dirs[GPSIFD]) != 0 {
+		t.Fatal("GPS not stripped")
+	}
+	if _, ok := e2.Get(ExifIFD, TagBodySerialNumber); ok {
+		t.Fatal("serial not stripped")
+	}
+	if d, ok := e2.Get(ExifIFD, TagDateTimeOriginal); !ok || d.String() != "2019:10:06 04:26:28" {
+		t.Fatalf("lost capture date %q", d.String())
+	}
+	if _, ok := e2.Get(IFD0, TagOrientation); !ok {
+		t.Fatal("lost orientation")
+	}
+	if e2.makerNoteOff != mnOff {
+		t.Fatalf("maker note moved %d -> %d", mnOff, e2.makerNoteOff)
+	}
+	mn, _ := e2.Get(ExifIFD, TagMakerNote)
+	if !bytes.Equal(mn.Value.([]byte), []byte("Maker\x00note with absolute offsets")) {
+		t.Fatal("maker note corrupted")
+	}
+}
+
+func TestSetErrors(t *testing.T) {
+	e := New(binary.LittleEndian)
+	if e.Set(IFD0, Tag{TagOrientation, Long, []uint16{1}}) == nil {
+		t.Fatal("expected type mismatch error")
+	}
+	if e.Set(IFD0, Tag{tagGPSIFD, Long, []uint32{1}}) == nil {
+		t.Fatal("expected error setting pointer tag")
+	}
+	if err := e.Set(IFD0, Tag{TagArtist, ASCII, string(make([]byte, 70000))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Marshal(); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	b, err := sample(binary.LittleEndian).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Must not panic on truncated or garbled data.
+	for i := 0; i < len(b); i++ {
+		Parse(b[:i])
+		c := append([]byte(nil), b...)
+		c[i] ^= 0xff
+		Parse(c)
+	}
+}
+
+func TestReadJPEG(t *testing.T) {
+	app1, err := sample(binary.LittleEndian).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := func(code byte, data []byte) []byte {
+		return append([]byte{0xff, code, byte((len(data) + 2) >> 8), byte(len(data) + 2)}, data...)
+	}
+	var f []byte
+	f = append(f, 0xff, 0xd8)
+	f = append(f, seg(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))...)
+	f = append(f, seg(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x/>"))...)
+	f = append(f, seg(0xe1, app1)...)
+	f = append(f, seg(0xda, []byte{0})...)
+	e, err := ReadJPEG(bytes.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := e.Get(IFD0, TagMake); m.String() != "Camera Co." {
+		t.Fatalf("make %q", m.String())
+	}
+	if th, err := ReadThumbnail(bytes.NewReader(f)); err != nil || !bytes.Equal(th, e.Thumbnail) {
+		t.Fatalf("thumbnail %q %v", th, err)
+	}
+	if _, err := ReadJPEG(bytes.NewReader(f[:len(f)-len(app1)-10])); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,356 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Type of tag value, as defined by TIFF.
+type Type uint16
+
+const (
+	Byte      Type = 1  // []byte
+	ASCII     Type = 2  // string
+	Short     Type = 3  // []uint16
+	Long      Type = 4  // []uint32
+	Rational  Type = 5  // []Rat
+	SByte     Type = 6  // []int8
+	Undefined Type = 7  // []byte
+	SShort    Type = 8  // []int16
+	SLong     Type = 9  // []int32
+	SRational Type = 10 // []SRat
+	Float     Type = 11 // []float32
+	Double    Type = 12 // []float64
+)
+
+var typeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// Size of one value of the type in bytes, 0 for unknown types.
+func (t Type) Size() int {
+	if int(t) >= len(typeSizes) {
+		return 0
+	}
+	return typeSizes[t]
+}
+
+// Unsigned rational.
+type Rat struct{ Num, Den uint32 }
+
+// Signed rational.
+type SRat struct{ Num, Den int32 }
+
+// Tag is one directory entry. Value is a Go slice matching the Type (see constants),
+// or string for ASCII.
+type Tag struct {
+	ID    uint16
+	Type  Type
+	Value interface{}
+}
+
+// Some well known tags.
+const (
+	// IFD0, IFD1
+	TagCompression      = 0x0103 // 6 for JPEG thumbnail in IFD1
+	TagImageDescription = 0x010e
+	TagMake             = 0x010f
+	TagModel            = 0x0110
+	TagOrientation      = 0x0112
+	TagXResolution      = 0x011a
+	TagYResolution      = 0x011b
+	TagResolutionUnit   = 0x0128
+	TagSoftware         = 0x0131
+	TagDateTime         = 0x0132
+	TagArtist           = 0x013b
+	TagCopyright        = 0x8298
+
+	// Exif
+	TagExposureTime      = 0x829a
+	TagFNumber           = 0x829d
+	TagISO               = 0x8827
+	TagDateTimeOriginal  = 0x9003
+	TagDateTimeDigitized = 0x9004
+	TagOffsetTime        = 0x9010
+	TagFocalLength       = 0x920a
+	TagMakerNote         = 0x927c
+	TagUserComment       = 0x9286
+	TagColorSpace        = 0xa001
+	TagPixelXDimension   = 0xa002
+	TagPixelYDimension   = 0xa003
+	TagImageUniqueID     = 0xa420
+	TagCameraOwnerName   = 0xa430
+	TagBodySerialNumber  = 0xa431
+	TagLensMake          = 0xa433
+	TagLensModel         = 0xa434
+	TagLensSerialNumber  = 0xa435
+
+	// GPS
+	TagGPSVersionID    = 0x0000
+	TagGPSLatitudeRef  = 0x0001
+	TagGPSLatitude     = 0x0002
+	TagGPSLongitudeRef = 0x0003
+	TagGPSLongitude    = 0x0004
+	TagGPSAltitude     = 0x0006
+
+	// Managed by the package, never seen in Dirs.
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+	tagInteropIFD  = 0xa005
+	tagThumbOffset = 0x0201
+	tagThumbLength = 0x0202
+)
+
+// Number of values in the tag.
+func (t Tag) Count() int {
+	switch v := t.Value.(type) {
+	case string:
+		return len(v) + 1 // NUL terminated
+	case []byte:
+		return len(v)
+	case []uint16:
+		return len(v)
+	case []uint32:
+		return len(v)
+	case []Rat:
+		return len(v)
+	case []int8:
+		return len(v)
+	case []int16:
+		return len(v)
+	case []int32:
+		return len(v)
+	case []SRat:
+		return len(v)
+	case []float32:
+		return len(v)
+	case []float64:
+		return len(v)
+	}
+	return 0
+}
+
+// Get i-th value of unsigned integer type (Byte, Short, Long).
+func (t Tag) Uint(i int) (uint64, bool) {
+	switch v := t.Value.(type) {
+	case []byte:
+		if i < len(v) && t.Type == Byte {
+			return uint64(v[i]), true
+		}
+	case []uint16:
+		if i < len(v) {
+			return uint64(v[i]), true
+		}
+	case []uint32:
+		if i < len(v) {
+			return uint64(v[i]), true
+		}
+	}
+	return 0, false
+}
+
+// Get i-th value of signed integer type (SByte, SShort, SLong).
+func (t Tag) Int(i int) (int64, bool) {
+	switch v := t.Value.(type) {
+	case []int8:
+		if i < len(v) {
+			return int64(v[i]), true
+		}
+	case []int16:
+		if i < len(v) {
+			return int64(v[i]), true
+		}
+	case []int32:
+		if i < len(v) {
+			return int64(v[i]), true
+		}
+	}
+	if u, ok := t.Uint(i); ok {
+		return int64(u), true
+	}
+	return 0, false
+}
+
+// Get i-th value of any numeric type as float.
+func (t Tag) Float(i int) (float64, bool) {
+	switch v := t.Value.(type) {
+	case []Rat:
+		if i < len(v) && v[i].Den != 0 {
+			return float64(v[i].Num) / float64(v[i].Den), true
+		}
+		return 0, false
+	case []SRat:
+		if i < len(v) && v[i].Den != 0 {
+			return float64(v[i].Num) / float64(v[i].Den), true
+		}
+		return 0, false
+	case []float32:
+		if i < len(v) {
+			return float64(v[i]), true
+		}
+		return 0, false
+	case []float64:
+		if i < len(v) {
+			return v[i], true
+		}
+		return 0, false
+	}
+	n, ok := t.Int(i)
+	return float64(n), ok
+}
+
+// Get value of ASCII tag.
+func (t Tag) String() string {
+	s, _ := t.Value.(string)
+	return s
+}
+
+func decodeValue(o binary.ByteOrder, t Type, n int, b []byte) interface{} {
+	switch t {
+	case ASCII:
+		b = b[:n]
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	case Byte, Undefined:
+		return append([]byte(nil), b[:n]...)
+	case SByte:
+		v := make([]int8, n)
+		for i := range v {
+			v[i] = int8(b[i])
+		}
+		return v
+	case Short:
+		v := make([]uint16, n)
+		for i := range v {
+			v[i] = o.Uint16(b[i*2:])
+		}
+		return v
+	case SShort:
+		v := make([]int16, n)
+		for i := range v {
+			v[i] = int16(o.Uint16(b[i*2:]))
+		}
+		return v
+	case Long:
+		v := make([]uint32, n)
+		for i := range v {
+			v[i] = o.Uint32(b[i*4:])
+		}
+		return v
+	case SLong:
+		v := make([]int32, n)
+		for i := range v {
+			v[i] = int32(o.Uint32(b[i*4:]))
+		}
+		return v
+	case Rational:
+		v := make([]Rat, n)
+		for i := range v {
+			v[i] = Rat{o.Uint32(b[i*8:]), o.Uint32(b[i*8+4:])}
+		}
+		return v
+	case SRational:
+		v := make([]SRat, n)
+		for i := range v {
+			v[i] = SRat{int32(o.Uint32(b[i*8:])), int32(o.Uint32(b[i*8+4:]))}
+		}
+		return v
+	case Float:
+		v := make([]float32, n)
+		for i := range v {
+			v[i] = math.Float32frombits(o.Uint32(b[i*4:]))
+		}
+		return v
+	case Double:
+		v := make([]float64, n)
+		for i := range v {
+			v[i] = math.Float64frombits(o.Uint64(b[i*8:]))
+		}
+		return v
+	}
+	return nil
+}
+
+// Serialize value into dst, which must be big enough.
+func encodeValue(o binary.ByteOrder, dst []byte, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		copy(dst, v)
+		dst[len(v)] = 0
+	case []byte:
+		copy(dst, v)
+	case []int8:
+		for i, x := range v {
+			dst[i] = byte(x)
+		}
+	case []uint16:
+		for i, x := range v {
+			o.PutUint16(dst[i*2:], x)
+		}
+	case []int16:
+		for i, x := range v {
+			o.PutUint16(dst[i*2:], uint16(x))
+		}
+	case []uint32:
+		for i, x := range v {
+			o.PutUint32(dst[i*4:], x)
+		}
+	case []int32:
+		for i, x := range v {
+			o.PutUint32(dst[i*4:], uint32(x))
+		}
+	case []Rat:
+		for i, x := range v {
+			o.PutUint32(dst[i*8:], x.Num)
+			o.PutUint32(dst[i*8+4:], x.Den)
+		}
+	case []SRat:
+		for i, x := range v {
+			o.PutUint32(dst[i*8:], uint32(x.Num))
+			o.PutUint32(dst[i*8+4:], uint32(x.Den))
+		}
+	case []float32:
+		for i, x := range v {
+			o.PutUint32(dst[i*4:], math.Float32bits(x))
+		}
+	case []float64:
+		for i, x := range v {
+			o.PutUint64(dst[i*8:], math.Float64bits(x))
+		}
+	}
+}
+
+// Check that Go type of the value matches tag type.
+func (t Tag) valid() bool {
+	switch t.Value.(type) {
+	case string:
+		return t.Type == ASCII
+	case []byte:
+		return t.Type == Byte || t.Type == Undefined
+	case []int8:
+		return t.Type == SByte
+	case []uint16:
+		return t.Type == Short
+	case []int16:
+		return t.Type == SShort
+	case []uint32:
+		return t.Type == Long
+	case []int32:
+		return t.Type == SLong
+	case []Rat:
+		return t.Type == Rational
+	case []SRat:
+		return t.Type == SRational
+	case []float32:
+		return t.Type == Float
+	case []float64:
+		return t.Type == Double
+	}
+	return false
+}
+
+func sortTags(tags []Tag) {
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+}
@@ -0,0 +1,241 @@
+package exif
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Get a tag from directory.
+func (e *Exif) Get(d Dir, id uint16) (Tag, bool) {
+	for _, t := range e.Dirs[d] {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Tag{}, false
+}
+
+// Add or replace a tag in directory.
+func (e *Exif) Set(d Dir, t Tag) error {
+	if !t.valid() {
+		return errors.New("exif: tag value doesn't match its type")
+	}
+	if managed(d, t.ID) {
+		return errors.New("exif: offset tags are managed automatically")
+	}
+	for i := range e.Dirs[d] {
+		if e.Dirs[d][i].ID == t.ID {
+			e.Dirs[d][i] = t
+			return nil
+		}
+	}
+	e.Dirs[d] = append(e.Dirs[d], t)
+	sortTags(e.Dirs[d])
+	return nil
+}
+
+// Check if tag is an offset the package takes care of.
+func managed(d Dir, id uint16) bool {
+	switch d {
+	case IFD0:
+		return id == tagExifIFD || id == tagGPSIFD
+	case ExifIFD:
+		return id == tagInteropIFD
+	case IFD1:
+		return id == tagThumbOffset || id == tagThumbLength
+	}
+	return false
+}
+
+// Remove a tag from directory. Returns false if there was no such tag.
+func (e *Exif) Delete(d Dir, id uint16) bool {
+	for i, t := range e.Dirs[d] {
+		if t.ID == id {
+			e.Dirs[d] = append(e.Dirs[d][:i], e.Dirs[d][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove whole directory. Interop goes away with Exif, and thumbnail with IFD1.
+func (e *Exif) DeleteDir(d Dir) {
+	e.Dirs[d] = nil
+	switch d {
+	case ExifIFD:
+		e.Dirs[InteropIFD] = nil
+	case IFD1:
+		e.Thumbnail = nil
+	}
+}
+
+// Set JPEG thumbnail, replacing the old one. nil removes the thumbnail along with IFD1.
+func (e *Exif) SetThumbnail(jpg []byte) {
+	if jpg == nil {
+		e.DeleteDir(IFD1)
+		return
+	}
+	e.Thumbnail = jpg
+	e.Set(IFD1, Tag{TagCompression, Short, []uint16{6}})
+}
+
+// Remove location data.
+func (e *Exif) StripGPS() {
+	e.DeleteDir(GPSIFD)
+}
+
+// Remove tags identifying the owner and the camera body or lens. Maker notes often
+// contain serial numbers too, remove TagMakerNote if that's a concern.
+func (e *Exif) StripSerials() {
+	e.Delete(ExifIFD, TagCameraOwnerName)
+	e.Delete(ExifIFD, TagBodySerialNumber)
+	e.Delete(ExifIFD, TagLensSerialNumber)
+	e.Delete(ExifIFD, TagImageUniqueID)
+}
+
+// Serializes the TIFF structure, keeping one reserved area untouched.
+type writer struct {
+	buf           []byte
+	resv, resvEnd int
+}
+
+// Allocate n bytes at word boundary, skipping over the reserved area.
+func (w *writer) alloc(n int) int {
+	off := (len(w.buf) + 1) &^ 1
+	if w.resvEnd > w.resv && off < w.resvEnd && off+n > w.resv {
+		off = (w.resvEnd + 1) &^ 1
+	}
+	w.grow(off + n)
+	return off
+}
+
+func (w *writer) grow(n int) {
+	if n > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, n-len(w.buf))...)
+	}
+}
+
+// Serialize into APP1 payload, including the Header.
+func (e *Exif) Marshal() ([]byte, error) {
+	o := e.Order
+	if o == nil {
+		o = binary.BigEndian
+	}
+	dirs := e.Dirs
+	has := [numDirs]bool{
+		IFD0:       true,
+		ExifIFD:    len(dirs[ExifIFD]) > 0 || len(dirs[InteropIFD]) > 0,
+		GPSIFD:     len(dirs[GPSIFD]) > 0,
+		InteropIFD: len(dirs[InteropIFD]) > 0,
+		IFD1:       len(dirs[IFD1]) > 0 || e.Thumbnail != nil,
+	}
+
+	// Put the maker note back where it was.
+	w := &writer{buf: make([]byte, 8)}
+	if mn, ok := e.Get(ExifIFD, TagMakerNote); ok && e.makerNoteOff >= 8 && mn.Count() > 4 {
+		w.resv, w.resvEnd = e.makerNoteOff, e.makerNoteOff+mn.Count()
+	}
+
+	// Lay out directory blocks first, so that pointers are known. Pointer tags
+	// are counted in as well.
+	var offs [numDirs]int
+	var nptr [numDirs]int
+	if has[ExifIFD] {
+		nptr[IFD0]++
+	}
+	if has[GPSIFD] {
+		nptr[IFD0]++
+	}
+	if has[InteropIFD] {
+		nptr[ExifIFD]++
+	}
+	if e.Thumbnail != nil {
+		nptr[IFD1] += 2
+	}
+	for _, d := range []Dir{IFD0, ExifIFD, InteropIFD, GPSIFD, IFD1} {
+		if has[d] {
+			offs[d] = w.alloc(2 + (len(dirs[d])+nptr[d])*12 + 4)
+		}
+	}
+	var thumbOff int
+	if e.Thumbnail != nil {
+		thumbOff = w.alloc(len(e.Thumbnail))
+		copy(w.buf[thumbOff:], e.Thumbnail)
+	}
+
+	// Now fill in the entries
+	for d := Dir(0); d < numDirs; d++ {
+		if !has[d] {
+			continue
+		}
+		tags := append([]Tag(nil), dirs[d]...)
+		ptr := func(id uint16, off int) {
+			tags = append(tags, Tag{ID: id, Type: Long, Value: []uint32{uint32(off)}})
+		}
+		switch d {
+		case IFD0:
+			if has[ExifIFD] {
+				ptr(tagExifIFD, offs[ExifIFD])
+			}
+			if has[GPSIFD] {
+				ptr(tagGPSIFD, offs[GPSIFD])
+			}
+		case ExifIFD:
+			if has[InteropIFD] {
+				ptr(tagInteropIFD, offs[InteropIFD])
+			}
+		case IFD1:
+			if e.Thumbnail != nil {
+				ptr(tagThumbOffset, thumbOff)
+				ptr(tagThumbLength, len(e.Thumbnail))
+			}
+		}
+		sortTags(tags)
+
+		pos := offs[d]
+		o.PutUint16(w.buf[pos:], uint16(len(tags)))
+		pos += 2
+		for _, t := range tags {
+			if !t.valid() {
+				return nil, errors.New("exif: tag value doesn't match its type")
+			}
+			n := t.Count()
+			size := n * t.Type.Size()
+			o.PutUint16(w.buf[pos:], t.ID)
+			o.PutUint16(w.buf[pos+2:], uint16(t.Type))
+			o.PutUint32(w.buf[pos+4:], uint32(n))
+			if size <= 4 {
+				encodeValue(o, w.buf[pos+8:pos+12], t.Value)
+			} else {
+				var voff int
+				if d == ExifIFD && t.ID == TagMakerNote && w.resvEnd > w.resv {
+					voff = w.resv
+					w.grow(w.resvEnd)
+				} else {
+					voff = w.alloc(size)
+				}
+				encodeValue(o, w.buf[voff:voff+size], t.Value)
+				o.PutUint32(w.buf[pos+8:], uint32(voff))
+			}
+			pos += 12
+		}
+		// IFD0 links to IFD1
+		if d == IFD0 && has[IFD1] {
+			o.PutUint32(w.buf[pos:], uint32(offs[IFD1]))
+		}
+	}
+
+	// TIFF header
+	if o.Uint16([]byte{1, 0}) == 1 {
+		copy(w.buf, "II")
+	} else {
+		copy(w.buf, "MM")
+	}
+	o.PutUint16(w.buf[2:], 42)
+	o.PutUint32(w.buf[4:], uint32(offs[IFD0]))
+
+	if len(Header)+len(w.buf) > 0xffff-2 {
+		return nil, ErrTooLarge
+	}
+	return append(append([]byte(nil), Header...), w.buf...), nil
+}
@@ -31,8 +31,11 @@ func skipInputData(self unsafe.Pointer, n C.long) {
 			}
 			got, err := r.Read(r.readBuf[:ts])
 			skip -= got
-			if got == 0 || err != nil {
-				panic(err)
+			if got == 0 {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				panic(ioError{err})
 			}
 		}
 		// reset buffer
@@ -48,16 +51,18 @@ func fillInputBuffer(self unsafe.Pointer) bool {
 	r := (*decoder)(self)
 	got, err := r.Read(r.readBuf[:])
 	if got == 0 {
-		if r.NBRead == 0 {
-			if err == nil {
-				err = io.EOF
-			}
-			panic(err)
+		if err == nil {
+			err = io.EOF
+		}
+		if err != io.EOF || r.NBRead == 0 {
+			panic(ioError{err})
 		}
-		// EOI
+		// Truncated file, insert EOI
 		r.readBuf[0] = 255
-		r.readBuf[1] = 9
-		got = 2
+		r.readBuf[1] = 0xd9
+		r.setBuffer(2)
+		r.NBRead -= 2
+		return true
 	}
 	r.setBuffer(got)
 	return true
@@ -65,19 +70,34 @@ func fillInputBuffer(self unsafe.Pointer) bool {
 
 //export outputBuffer
 func outputBuffer(self unsafe.Pointer) bool {
+	// Buffer is full, free_in_buffer isn't reliable here.
+	(*encoder)(self).flush(0)
+	return true
+}
+
+//export termDestination
+func termDestination(self unsafe.Pointer) {
 	w := (*encoder)(self)
-	inBuf := bufferSize - int(w.cInfo.dest.free_in_buffer)
+	w.flush(int(w.cInfo.dest.free_in_buffer))
+}
+
+// Pass on what libjpeg wrote, with free bytes left in the buffer.
+func (w *encoder) flush(free int) {
+	if w.Writer == nil {
+		w.setAppend(cap(w.out) - len(w.out) - free)
+		return
+	}
+	inBuf := bufferSize - free
 	if inBuf > 0 {
 		wrote, err := w.Write(w.writeBuf[:inBuf])
 		if err != nil {
-			panic(err)
+			panic(ioError{err})
 		}
 		if wrote < inBuf {
 			throw("truncated write, %d < %d", wrote, inBuf)
 		}
 	}
 	w.setBuffer(inBuf)
-	return true
 }
 
 //export errorPanic
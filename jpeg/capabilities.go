@@ -0,0 +1,113 @@
+//+build cgo
+
+package jpeg
+
+/*
+#include <stdio.h>
+#include <stdlib.h>
+#include <jpeglib.h>
+
+#define str(s) #s
+#define xstr(s) str(s)
+
+static const char *turboVersion(void) {
+#ifdef LIBJPEG_TURBO_VERSION
+	return xstr(LIBJPEG_TURBO_VERSION);
+#else
+	return NULL;
+#endif
+}
+
+#ifdef LIBJPEG_TURBO_VERSION_NUMBER
+#define TURBO_NUMBER LIBJPEG_TURBO_VERSION_NUMBER
+#else
+#define TURBO_NUMBER 0
+#endif
+
+// mozjpeg has a numbering of its own.
+#if !defined(JPEG_C_PARAM_SUPPORTED) && TURBO_NUMBER >= 3000000
+#define TURBO3 1
+#else
+#define TURBO3 0
+#endif
+
+#ifdef _WIN32
+// No weak references in PE, so go by the headers.
+#define have(sym, headers) (headers)
+#else
+// Whether the library exports sym, whatever its headers say.
+#define have(sym, headers) (lib_##sym != NULL)
+#define weak(sym) extern void lib_##sym(void) __asm__(xstr(__USER_LABEL_PREFIX__) #sym) __attribute__((weak));
+weak(jpeg12_write_scanlines)
+weak(jpeg_enable_lossless)
+weak(jpeg_crop_scanline)
+weak(jpeg_skip_scanlines)
+weak(jpeg_read_icc_profile)
+weak(jpeg_write_icc_profile)
+#endif
+
+struct features {
+	int bits12, lossless, cropSkip, icc;
+};
+
+static void getFeatures(struct features *f) {
+	f->bits12 = BITS_IN_JSAMPLE == 12 || have(jpeg12_write_scanlines, TURBO3);
+	f->lossless = have(jpeg_enable_lossless, TURBO3);
+	f->cropSkip = have(jpeg_crop_scanline, TURBO_NUMBER >= 1005000) && have(jpeg_skip_scanlines, 1);
+	f->icc = have(jpeg_read_icc_profile, TURBO_NUMBER >= 2000000) && have(jpeg_write_icc_profile, 1);
+}
+
+// Version the library reports in messages, such as "9e  16-Jan-2022". JMSG_VERSION
+// is the second message of all versions, and jerror.h isn't always around.
+static const char *messageVersion(void) {
+	struct jpeg_error_mgr err;
+	jpeg_std_error(&err);
+	return err.jpeg_message_table[1];
+}
+*/
+import "C"
+import (
+	"bytes"
+	"image"
+	"sync"
+)
+
+var (
+	featuresOnce sync.Once
+	features     Features
+)
+
+// Report the linked JPEG library. Functions are looked up in the library itself where
+// the platform allows, so that headers of another library don't fool it. Arithmetic
+// coding is tried out.
+func Capabilities() Features {
+	featuresOnce.Do(func() {
+		var f C.struct_features
+		C.getFeatures(&f)
+		features = Features{
+			Library:    "libjpeg",
+			Version:    C.GoString(C.messageVersion()),
+			APIVersion: C.JPEG_LIB_VERSION,
+			CParams:    hasCParams,
+			Bits12:     f.bits12 != 0,
+			Lossless:   f.lossless != 0,
+			CropSkip:   f.cropSkip != 0,
+			ICC:        f.icc != 0,
+		}
+		if v := C.turboVersion(); v != nil {
+			features.Library = "libjpeg-turbo"
+			features.Version = C.GoString(v)
+		}
+		if hasCParams {
+			features.Library = "mozjpeg"
+		}
+
+		var buf bytes.Buffer
+		img := image.NewGray(image.Rect(0, 0, 8, 8))
+		if Encode(&buf, img, &Options{ArithmeticCoding: true, NoProgressive: true}) == nil {
+			_, err := DecodeBytes(buf.Bytes(), nil)
+			features.Arithmetic = err == nil
+		}
+	})
+	return features
+}
@@ -0,0 +1,359 @@
+//+build cgo
+
+package jpeg
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ezdiy/image/util"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Tests of what needs libjpeg.
+
+func TestOptimize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 150))
+	gradient(img)
+	var src bytes.Buffer
+	markers := Markers{{MarkerAPP1, []byte("Exif\x00\x00")}, {MarkerCOM, []byte("comment")}}
+	if err := Encode(&src, img, &Options{NoProgressive: true, FastHufftab: true, Markers: markers}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(bytes.NewReader(src.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []Options{{}, {NoProgressive: true}, {ArithmeticCoding: true}, {StripMetadata: true}} {
+		var dst bytes.Buffer
+		var n int
+		opt.NBWritten = &n
+		if err := Optimize(&dst, bytes.NewReader(src.Bytes()), &opt); err != nil {
+			t.Fatal(err)
+		}
+		// Progressive may not pay off on an image this small.
+		if n != dst.Len() || (opt.NoProgressive && n >= src.Len()) {
+			t.Fatalf("%+v: %d bytes written, %d -> %d", opt, n, src.Len(), dst.Len())
+		}
+		var got Markers
+		var density Density
+		img, err := DecodeImage(bytes.NewReader(dst.Bytes()), &DecoderOptions{Markers: &got, Density: &density})
+		if err != nil {
+			t.Fatalf("%+v: %v", opt, err)
+		}
+		if !reflect.DeepEqual(img, want) {
+			t.Fatalf("%+v: pixels changed", opt)
+		}
+		if opt.StripMetadata {
+			markers = Markers{}
+		}
+		if len(got) == 0 || got[0].Code != MarkerAPP0 || !reflect.DeepEqual(got[1:], markers) {
+			t.Fatalf("%+v: markers %v", opt, got)
+		}
+		if density != (Density{DensityNone, 1, 1}) {
+			t.Fatalf("%+v: density %+v", opt, density)
+		}
+	}
+	if err := Optimize(ioutil.Discard, bytes.NewReader([]byte("not a jpeg")), nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 150))
+	gradient(img)
+	src := func(opt *Options) []byte {
+		var buf bytes.Buffer
+		opt.NoProgressive, opt.FastHufftab = true, true
+		opt.Markers = Markers{{MarkerCOM, bytes.Repeat([]byte("x"), 1000)}}
+		if err := Encode(&buf, img, opt); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for _, c := range []struct {
+		src    []byte
+		policy Policy
+		action TranscodeAction
+	}{
+		{src(&Options{Quality: 95}), Policy{}, ActionReencode},
+		{src(&Options{Quality: 95}), Policy{QualityMargin: 20}, ActionOptimize},
+		{src(&Options{Quality: 60}), Policy{}, ActionOptimize},
+		{src(&Options{Quality: 60}), Policy{NoOptimize: true}, ActionPassThrough},
+		{src(&Options{Quality: 60}), Policy{NoOptimize: true, MaxMetadata: 100}, ActionStrip},
+		{src(&Options{Quality: 60, UseSubsampling: true}), Policy{Options: Options{Subsampling: image.YCbCrSubsampleRatio420, UseSubsampling: true}}, ActionReencode},
+	} {
+		var buf bytes.Buffer
+		res, err := Transcode(&buf, bytes.NewReader(c.src), &c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != c.action {
+			t.Fatalf("%+v: %v instead of %v", c.policy, res.Action, c.action)
+		}
+		if res.In != len(c.src) || res.Out != buf.Len() || res.Savings() < 0 || res.Metadata < 1000 {
+			t.Fatalf("%+v: bad result %+v", c.policy, res)
+		}
+		if res.Action == ActionPassThrough && !bytes.Equal(buf.Bytes(), c.src) {
+			t.Fatal("pass-through modified data")
+		}
+		h, err := probe(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stripped := len(h.markers) == 1 // JFIF only
+		if stripped != (res.Action == ActionStrip) {
+			t.Fatalf("%+v: %d markers left", c.policy, len(h.markers))
+		}
+		if res.Action == ActionReencode && (h.quality.Luma != 75 || h.ratio != image.YCbCrSubsampleRatio420) {
+			t.Fatalf("%+v: re-encoded as %+v", c.policy, h)
+		}
+		if res.Action == ActionOptimize && !h.progressive {
+			t.Fatal("optimized output not progressive")
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 150))
+	gradient(img)
+	var buf bytes.Buffer
+	opt := &Options{Quality: 50, NoProgressive: true, Markers: Markers{{MarkerCOM, []byte("hi")}}}
+	if err := Encode(&buf, img, opt); err != nil {
+		t.Fatal(err)
+	}
+	file := append(buf.Bytes(), "junk"...)
+	info, err := Inspect(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != FrameBaseline || info.Arithmetic || info.Precision != 8 || info.Size != image.Pt(200, 150) {
+		t.Fatalf("bad frame %+v", info)
+	}
+	if len(info.Components) != 3 || info.Components[0] != (ComponentInfo{1, 2, 2, 0}) || info.Components[2] != (ComponentInfo{3, 1, 1, 1}) {
+		t.Fatalf("bad components %+v", info.Components)
+	}
+	if len(info.Scans) != 1 || len(info.Scans[0].Components) != 3 || info.Scans[0].Se != 63 {
+		t.Fatalf("bad scans %+v", info.Scans)
+	}
+	if len(info.QuantTables) != 2 || info.QuantTables[0].Values[1] != 11 || info.QuantTables[0].Values[8] != 12 {
+		t.Fatalf("bad quant tables %+v", info.QuantTables)
+	}
+	if len(info.HuffmanTables) != 4 || info.Trailing != 4 {
+		t.Fatalf("%d huffman tables, %d trailing", len(info.HuffmanTables), info.Trailing)
+	}
+	ms := info.Markers
+	if ms[0].Code != 0xd8 || ms[1] != (MarkerInfo{MarkerAPP0, 2, 18}) || ms[2] != (MarkerInfo{MarkerCOM, 20, 6}) {
+		t.Fatalf("bad markers %+v", ms[:3])
+	}
+	scan := info.Scans[0]
+	if eoi := ms[len(ms)-1]; eoi.Code != 0xd9 || eoi.Offset != scan.Offset+scan.Length {
+		t.Fatalf("EOI at %d, scan ends at %d", eoi.Offset, scan.Offset+scan.Length)
+	}
+
+	buf.Reset()
+	if err := Optimize(&buf, bytes.NewReader(file), &Options{ArithmeticCoding: true}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = Inspect(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != FrameProgressive || !info.Arithmetic || info.SOF != 0xca || len(info.Scans) < 2 || len(info.HuffmanTables) != 0 {
+		t.Fatalf("bad progressive frame %+v", info)
+	}
+	if s := info.Scans[0]; s.Ss != 0 || s.Se != 0 || s.Ah != 0 {
+		t.Fatalf("bad first scan %+v", s)
+	}
+
+	info, err = Inspect(bytes.NewReader(file[:len(file)/2]))
+	if err != io.ErrUnexpectedEOF || info.Size != image.Pt(200, 150) {
+		t.Fatalf("truncated: %v", err)
+	}
+	if _, err = Inspect(bytes.NewReader(file[2:])); err != util.ErrNotJPEG {
+		t.Fatalf("expected ErrNotJPEG, got %v", err)
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(img)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	ref, err := DecodeImage(bytes.NewReader(file), &DecoderOptions{OutputColorspaces: []color.Model{color.RGBAModel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []Quantize{
+		{Colors: 16},
+		{Colors: 16, Dither: DitherNone},
+		{Colors: 216, OnePass: true, Dither: DitherOrdered},
+	} {
+		got, err := DecodeImage(bytes.NewReader(file), &DecoderOptions{Quantize: &q})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, ok := got.(*image.Paletted)
+		if !ok || len(p.Palette) > q.Colors || p.Bounds() != img.Bounds() {
+			t.Fatalf("%+v: got %T", q, got)
+		}
+		if _, ok := p.Palette[0].(color.RGBA); !ok {
+			t.Fatalf("%+v: palette of %T", q, p.Palette[0])
+		}
+		checkSimilar(t, fmt.Sprintf("%+v", q), ref, p, 96)
+	}
+
+	bw := color.Palette{color.Black, color.White}
+	got, err := DecodeImage(bytes.NewReader(file), &DecoderOptions{Quantize: &Quantize{Palette: bw, Dither: DitherNone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := got.(*image.Paletted); !reflect.DeepEqual(p.Palette, bw) || p.ColorIndexAt(0, 0) != 0 {
+		t.Fatalf("fixed palette: %v, %d", p.Palette, p.ColorIndexAt(0, 0))
+	}
+
+	// Next decode isn't affected.
+	if got, err = Decode(bytes.NewReader(file)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.(*image.YCbCr); !ok {
+		t.Fatalf("got %T after quantized decode", got)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	gradient(img)
+	var buf bytes.Buffer
+	var nb int
+	if err := Encode(&buf, img, &Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := AppendEncode([]byte("prefix"), img, &Options{Quality: 90, NBWritten: &nb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out[:6]) != "prefix" || !bytes.Equal(out[6:], buf.Bytes()) || nb != buf.Len() {
+		t.Fatalf("appended %d bytes, %d written, want %d", len(out)-6, nb, buf.Len())
+	}
+	if _, err := AppendEncode(out, image.NewGray(image.Rect(0, 0, 0, 0)), nil); err == nil {
+		t.Fatal("empty image encoded")
+	}
+
+	ref, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeBytes(out[6:], &DecoderOptions{NBRead: &nb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.(*image.YCbCr).Y, ref.(*image.YCbCr).Y) {
+		t.Fatal("decoded differently")
+	}
+	if _, err = DecodeBytes(out[6:len(out)/2], nil); err != nil {
+		t.Fatal("truncated file:", err)
+	}
+	if _, err = DecodeBytes(nil, nil); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDeblock(t *testing.T) {
+	// Smooth shapes suffer blocking the most.
+	img := image.NewGray(image.Rect(0, 0, 123, 77))
+	for y := 0; y < 77; y++ {
+		for x := 0; x < 123; x++ {
+			dx, dy := float64(x-60), float64(y-40)
+			img.Pix[y*img.Stride+x] = byte(128 + 100*math.Sin(math.Sqrt(dx*dx+dy*dy)/12))
+		}
+	}
+	mse := func(got image.Image) (sum float64) {
+		g := got.(*image.Gray)
+		if g.Rect != img.Rect {
+			t.Fatalf("deblocked image of %v", g.Rect)
+		}
+		for y := 0; y < 77; y++ {
+			for x := 0; x < 123; x++ {
+				d := float64(g.Pix[y*g.Stride+x]) - float64(img.Pix[y*img.Stride+x])
+				sum += d * d
+			}
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Quality: 10}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := DecodeBytes(buf.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smooth, err := DecodeBytes(buf.Bytes(), &DecoderOptions{Deblock: &Deblock{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := mse(plain), mse(smooth); b > a*0.8 {
+		t.Fatalf("deblocked error %.0f, plain %.0f", b, a)
+	}
+
+	// Color goes the same way, into any model.
+	rgb := image.NewNRGBA(image.Rect(0, 0, 123, 77))
+	gradient(rgb)
+	buf.Reset()
+	if err := Encode(&buf, rgb, &Options{Quality: 20}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range AllColorspaces[:3] {
+		got, err := DecodeBytes(buf.Bytes(), &DecoderOptions{Deblock: &Deblock{Iterations: 5}, OutputColorspaces: []color.Model{m}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ColorModel() != m {
+			t.Fatalf("decoded into %T, want %v", got, m)
+		}
+		if m != color.GrayModel {
+			checkSimilar(t, "deblocked", rgb, got, 24)
+		}
+	}
+}
+
+// Pooled encoder must not keep Huffman tables optimized for the previous image.
+func TestEncoderReuse(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(img)
+	encode := func(opt *Options) []byte {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, opt); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	fast := &Options{FastHufftab: true, NoProgressive: true}
+	want := encode(fast)
+	for i := 0; i < 4; i++ {
+		encode(&Options{Quality: 90 + i})
+		if got := encode(fast); !bytes.Equal(got, want) {
+			t.Fatalf("round %d: standard tables not restored", i)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	f := Capabilities()
+	t.Logf("%+v", f)
+	if f.Library == "" || f.Version == "" || f.APIVersion < 62 {
+		t.Fatalf("bad library %+v", f)
+	}
+	err := Encode(ioutil.Discard, image.NewGray(image.Rect(0, 0, 8, 8)), &Options{ArithmeticCoding: true})
+	if (err == nil) != f.Arithmetic {
+		t.Fatalf("arithmetic coding %v, got %v", f.Arithmetic, err)
+	}
+}
@@ -0,0 +1,172 @@
+package jpeg
+
+import (
+	"image"
+	"image/color"
+)
+
+// Converts one row of an image libjpeg can't take directly into 8-bit samples.
+// y is absolute, within Bounds().
+type rowConverter func(dst []byte, y int)
+
+type opaquer interface {
+	Opaque() bool
+}
+
+// Check if image has no transparent pixels. Images without Opaque() get scanned.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(opaquer); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Resolves alpha of 16-bit color samples according to AlphaPolicy.
+type blender struct {
+	ignore bool
+	bg     [3]uint32
+}
+
+func newBlender(policy AlphaPolicy, bg color.Color) (b *blender) {
+	b = &blender{ignore: policy == AlphaIgnore}
+	if bg == nil {
+		bg = color.White
+	}
+	b.bg[0], b.bg[1], b.bg[2], _ = bg.RGBA()
+	return
+}
+
+// Premultiplied color sample c of i-th component.
+func (b *blender) premul(c, a uint32, i int) byte {
+	if b.ignore {
+		if a == 0 {
+			return 0
+		}
+		return byte(c * 0xffff / a >> 8)
+	}
+	return byte((c + b.bg[i]*(0xffff-a)/0xffff) >> 8)
+}
+
+// Non-premultiplied color sample c of i-th component.
+func (b *blender) straight(c, a uint32, i int) byte {
+	if b.ignore {
+		return byte(c >> 8)
+	}
+	return byte((c*a + b.bg[i]*(0xffff-a)) / 0xffff >> 8)
+}
+
+// Pick a row converter for an image. Returns number of components it emits per pixel,
+// which is either 1 (gray) or 3 (RGB).
+func newRowConverter(img image.Image, bl *blender) (conv rowConverter, ncomp int) {
+	b := img.Bounds()
+	w := b.Dx()
+	switch im := img.(type) {
+	case *image.Gray16:
+		return func(dst []byte, y int) {
+			pix := im.Pix[im.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				dst[x] = pix[x*2]
+			}
+		}, 1
+	case *image.RGBA:
+		return func(dst []byte, y int) {
+			pix := im.Pix[im.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				p := pix[x*4:][:4]
+				a := uint32(p[3]) * 0x101
+				for i := 0; i < 3; i++ {
+					dst[x*3+i] = bl.premul(uint32(p[i])*0x101, a, i)
+				}
+			}
+		}, 3
+	case *image.RGBA64:
+		return func(dst []byte, y int) {
+			pix := im.Pix[im.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				p := pix[x*8:][:8]
+				a := uint32(p[6])<<8 | uint32(p[7])
+				for i := 0; i < 3; i++ {
+					dst[x*3+i] = bl.premul(uint32(p[i*2])<<8|uint32(p[i*2+1]), a, i)
+				}
+			}
+		}, 3
+	case *image.NRGBA:
+		return func(dst []byte, y int) {
+			pix := im.Pix[im.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				p := pix[x*4:][:4]
+				a := uint32(p[3]) * 0x101
+				for i := 0; i < 3; i++ {
+					dst[x*3+i] = bl.straight(uint32(p[i])*0x101, a, i)
+				}
+			}
+		}, 3
+	case *image.NRGBA64:
+		return func(dst []byte, y int) {
+			pix := im.Pix[im.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				p := pix[x*8:][:8]
+				a := uint32(p[6])<<8 | uint32(p[7])
+				for i := 0; i < 3; i++ {
+					dst[x*3+i] = bl.straight(uint32(p[i*2])<<8|uint32(p[i*2+1]), a, i)
+				}
+			}
+		}, 3
+	case *image.Paletted:
+		// Resolve palette once, as the interface calls are expensive. Pixels can't
+		// index past 255, so longer palettes are cut.
+		var lut [256][3]byte
+		pal := im.Palette
+		if len(pal) > len(lut) {
+			pal = pal[:len(lut)]
+		}
+		for i, c := range pal {
+			cr, cg, cb, a := c.RGBA()
+			lut[i] = [3]byte{bl.premul(cr, a, 0), bl.premul(cg, a, 1), bl.premul(cb, a, 2)}
+		}
+		return func(dst []byte, y int) {
+			pix := im.Pix[im.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				copy(dst[x*3:][:3], lut[pix[x]][:])
+			}
+		}, 3
+	case *image.NYCbCrA:
+		return func(dst []byte, y int) {
+			for x := 0; x < w; x++ {
+				yi := im.YOffset(b.Min.X+x, y)
+				ci := im.COffset(b.Min.X+x, y)
+				cr, cg, cb := color.YCbCrToRGB(im.Y[yi], im.Cb[ci], im.Cr[ci])
+				a := uint32(im.A[im.AOffset(b.Min.X+x, y)]) * 0x101
+				dst[x*3+0] = bl.straight(uint32(cr)*0x101, a, 0)
+				dst[x*3+1] = bl.straight(uint32(cg)*0x101, a, 1)
+				dst[x*3+2] = bl.straight(uint32(cb)*0x101, a, 2)
+			}
+		}, 3
+	}
+
+	// Generic and slow, the custom image types.
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return func(dst []byte, y int) {
+			for x := 0; x < w; x++ {
+				dst[x] = color.GrayModel.Convert(img.At(b.Min.X+x, y)).(color.Gray).Y
+			}
+		}, 1
+	}
+	return func(dst []byte, y int) {
+		for x := 0; x < w; x++ {
+			cr, cg, cb, a := img.At(b.Min.X+x, y).RGBA()
+			dst[x*3+0] = bl.premul(cr, a, 0)
+			dst[x*3+1] = bl.premul(cg, a, 1)
+			dst[x*3+2] = bl.premul(cb, a, 2)
+		}
+	}, 3
+}
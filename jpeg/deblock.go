@@ -0,0 +1,144 @@
+package jpeg
+
+import (
+	"math"
+)
+
+// Orthonormal 8x8 DCT basis, dctBasis[u][x]. Scaled the way JPEG coefficients are.
+var dctBasis = func() (m [8][8]float32) {
+	for u := range m {
+		c := 0.5
+		if u == 0 {
+			c = math.Sqrt(0.125)
+		}
+		for x := range m[u] {
+			m[u][x] = float32(c * math.Cos(float64((2*x+1)*u)*math.Pi/16))
+		}
+	}
+	return
+}()
+
+// Transform block in place, forward (pixels to coefficients) or inverse.
+func dct8x8(b *[64]float32, inverse bool) {
+	var t [64]float32
+	dctRows(&t, b, inverse)
+	dctRows(b, &t, inverse)
+}
+
+// Transform rows of src, storing them as columns of dst.
+func dctRows(dst, src *[64]float32, inverse bool) {
+	for y := 0; y < 8; y++ {
+		row := src[y*8:][:8]
+		for u := 0; u < 8; u++ {
+			var s float32
+			for x, v := range row {
+				if inverse {
+					s += dctBasis[x][u] * v
+				} else {
+					s += dctBasis[u][x] * v
+				}
+			}
+			dst[u*8+y] = s
+		}
+	}
+}
+
+// Reconstruct plane of w×h blocks from quantized coefficients (64 per block, in
+// natural order) and quantization table q. Total variation of the plane is minimized
+// by gradient descent, with each pass projected back so that coefficients stay inside
+// the interval they were quantized from. The result holds whole blocks, w*8 wide.
+func deblockPlane(coef []int16, q *[64]uint16, w, h int, opt *Deblock) []byte {
+	stride, rows := w*8, h*8
+	pix := make([]float32, stride*rows)
+	grad := make([]float32, len(pix))
+	lo := make([]float32, len(coef))
+	hi := make([]float32, len(coef))
+	for i, c := range coef {
+		k := float32(q[i%64])
+		lo[i], hi[i] = (float32(c)-0.5)*k, (float32(c)+0.5)*k
+	}
+
+	// Move blocks between pixels and coefficients, clamping them on the way.
+	var b [64]float32
+	blocks := func(project bool) {
+		for by := 0; by < h; by++ {
+			for bx := 0; bx < w; bx++ {
+				n := (by*w + bx) * 64
+				p := pix[by*8*stride+bx*8:]
+				if project {
+					for y := 0; y < 8; y++ {
+						for x := 0; x < 8; x++ {
+							b[y*8+x] = p[y*stride+x] - 128
+						}
+					}
+					dct8x8(&b, false)
+					for k, v := range b {
+						if v < lo[n+k] {
+							b[k] = lo[n+k]
+						} else if v > hi[n+k] {
+							b[k] = hi[n+k]
+						}
+					}
+				} else {
+					for k := range b {
+						b[k] = float32(coef[n+k]) * float32(q[k])
+					}
+				}
+				dct8x8(&b, true)
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						p[y*stride+x] = b[y*8+x] + 128
+					}
+				}
+			}
+		}
+	}
+	blocks(false)
+
+	iters := opt.Iterations
+	if iters == 0 {
+		iters = 20
+	}
+	strength := opt.Strength
+	if strength == 0 {
+		strength = 1
+	}
+	for it := 0; it < iters; it++ {
+		for i := range grad {
+			grad[i] = 0
+		}
+		// Gradient of sum of sqrt(dx²+dy²+1), forward differences.
+		for y := 0; y < rows; y++ {
+			for x := 0; x < stride; x++ {
+				i := y*stride + x
+				var dx, dy float32
+				if x+1 < stride {
+					dx = pix[i+1] - pix[i]
+				}
+				if y+1 < rows {
+					dy = pix[i+stride] - pix[i]
+				}
+				n := float32(math.Sqrt(float64(dx*dx + dy*dy + 1)))
+				dx, dy = dx/n, dy/n
+				grad[i] -= dx + dy
+				if x+1 < stride {
+					grad[i+1] += dx
+				}
+				if y+1 < rows {
+					grad[i+stride] += dy
+				}
+			}
+		}
+		step := float32(strength / math.Sqrt(float64(it+1)))
+		for i, g := range grad {
+			pix[i] -= step * g
+		}
+		blocks(true)
+	}
+
+	out := make([]byte, len(pix))
+	for i, v := range pix {
+		out[i] = uint8(math.Max(0, math.Min(255, math.Round(float64(v)))))
+	}
+	return out
+}
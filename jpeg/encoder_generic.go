@@ -0,0 +1,531 @@
+//+build !cgo
+
+package jpeg
+
+import (
+	"fmt"
+	"github.com/ezdiy/image/util"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// Baseline encoder with standard Huffman tables, so that subsampling, markers and
+// the rest work without libjpeg too.
+
+// Annex K Huffman tables.
+var (
+	// DC 0, AC 0, DC 1, AC 1
+	stdHuffSpecs = [4]huffSpec{{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}, {
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	}, {
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}, {
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	}}
+
+	// Codes of stdHuffSpecs, indexed by symbol.
+	stdHuff = func() (res [4]huffCodes) {
+		for i, s := range stdHuffSpecs {
+			code := uint32(0)
+			k := 0
+			for n, count := range s.counts {
+				for j := 0; j < int(count); j++ {
+					res[i][s.symbols[k]] = huffCode{code, uint8(n + 1)}
+					code++
+					k++
+				}
+				code <<= 1
+			}
+		}
+		return
+	}()
+)
+
+type huffSpec struct {
+	counts  [16]byte
+	symbols []byte
+}
+
+type huffCode struct {
+	code uint32
+	n    uint8
+}
+
+type huffCodes [256]huffCode
+
+// Component plane to encode.
+type plane struct {
+	pix       []byte
+	stride    int
+	w, h      int // Samples, edges get replicated past them
+	hs, vs    int // Sampling factors
+	id, table byte
+}
+
+// Entropy coder, appending to out.
+type bitWriter struct {
+	out   []byte
+	bits  uint32
+	nbits uint
+}
+
+func (b *bitWriter) emit(bits uint32, n uint) {
+	b.bits |= bits << (32 - b.nbits - n)
+	b.nbits += n
+	for b.nbits >= 8 {
+		c := byte(b.bits >> 24)
+		b.out = append(b.out, c)
+		if c == 0xff {
+			b.out = append(b.out, 0)
+		}
+		b.bits <<= 8
+		b.nbits -= 8
+	}
+}
+
+// Emit Huffman code of symbol, followed by n bits of value.
+func (b *bitWriter) emitValue(t *huffCodes, symbol byte, value int32, n uint) {
+	c := t[symbol]
+	b.emit(c.code, uint(c.n))
+	if n > 0 {
+		if value < 0 {
+			value--
+		}
+		b.emit(uint32(value)&(1<<n-1), n)
+	}
+}
+
+// Number of bits of magnitude of v.
+func bitLen(v int32) (n uint) {
+	if v < 0 {
+		v = -v
+	}
+	for v > 0 {
+		n++
+		v >>= 1
+	}
+	return
+}
+
+func Encode(o io.Writer, img image.Image, opt *Options) error {
+	out, err := encode(nil, img, opt)
+	if err != nil {
+		return err
+	}
+	_, err = o.Write(out)
+	return err
+}
+
+func AppendEncode(dst []byte, img image.Image, opt *Options) ([]byte, error) {
+	out, err := encode(dst, img, opt)
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// Append the file to dst.
+func encode(dst []byte, img image.Image, opt *Options) ([]byte, error) {
+	if opt == nil {
+		opt = &DefaultEncoderOptions
+	}
+	switch {
+	case opt.Ext != ExtOptions{}:
+		return nil, errNoCgo("ExtOptions")
+	case opt.ArithmeticCoding:
+		return nil, errNoCgo("ArithmeticCoding")
+	case opt.SmoothingFactor != 0:
+		return nil, errNoCgo("SmoothingFactor")
+	}
+	if opt.Alpha == AlphaError && !isOpaque(img) {
+		return nil, ErrTransparent
+	}
+	if opt.Thumbnail != (image.Point{}) {
+		markers, err := addThumbnail(img, opt)
+		if err != nil {
+			return nil, err
+		}
+		o := *opt
+		o.Markers, o.Thumbnail = markers, image.Point{}
+		opt = &o
+	}
+	if fuzz, ok := opt.grayFuzz(); ok && isOpaque(img) {
+		if gr := util.ToGray(img, fuzz); gr != nil {
+			img = gr
+		}
+	}
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return nil, fmt.Errorf("jpeg: empty image %v", b)
+	}
+
+	planes, cs, err := toPlanes(img, opt)
+	if err != nil {
+		return nil, err
+	}
+	out, err := writeFile(dst, b.Size(), planes, cs, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.NBWritten != nil {
+		*opt.NBWritten += len(out) - len(dst)
+	}
+	if opt.Grayscale != nil {
+		*opt.Grayscale = len(planes) == 1
+	}
+	return out, nil
+}
+
+// Split image into planes to encode, in the color space stored.
+func toPlanes(img image.Image, opt *Options) ([]plane, ColorSpace, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cs := opt.JPEGColorSpace
+	in := ColorSpaceRGB
+	switch im := img.(type) {
+	case *image.Gray:
+		in = ColorSpaceGray
+		if cs == ColorSpaceDefault || cs == ColorSpaceGray {
+			return []plane{{im.Pix[im.PixOffset(b.Min.X, b.Min.Y):], im.Stride, w, h, 1, 1, 1, 0}}, ColorSpaceGray, nil
+		}
+	case *image.YCbCr:
+		if cs == ColorSpaceDefault || cs == ColorSpaceYCbCr {
+			planes, err := yccPlanes(im)
+			return planes, ColorSpaceYCbCr, err
+		}
+	case *image.NYCbCrA:
+		if (cs == ColorSpaceDefault || cs == ColorSpaceYCbCr) && (opt.Alpha == AlphaIgnore || im.Opaque()) {
+			planes, err := yccPlanes(&im.YCbCr)
+			return planes, ColorSpaceYCbCr, err
+		}
+	case *image.CMYK:
+		in = ColorSpaceCMYK
+		if cs == ColorSpaceDefault || cs == ColorSpaceCMYK || cs == ColorSpaceYCCK {
+			if cs == ColorSpaceYCCK {
+				return cmykPlanes(im, true), cs, nil
+			}
+			return cmykPlanes(im, false), ColorSpaceCMYK, nil
+		}
+	}
+	conv, ncomp := newRowConverter(img, newBlender(opt.Alpha, opt.Background))
+	if ncomp == 1 {
+		in = ColorSpaceGray
+	}
+	if !cs.storableFrom(in) {
+		return nil, cs, fmt.Errorf("jpeg: can't store %v input as %v", in, cs)
+	}
+	if ncomp == 1 || cs == ColorSpaceGray {
+		pix := make([]byte, w*h)
+		row := make([]byte, w*ncomp)
+		for y := 0; y < h; y++ {
+			if ncomp == 1 {
+				conv(pix[y*w:][:w], b.Min.Y+y)
+				continue
+			}
+			conv(row, b.Min.Y+y)
+			for x := 0; x < w; x++ {
+				p := row[x*3:]
+				pix[y*w+x], _, _ = color.RGBToYCbCr(p[0], p[1], p[2])
+			}
+		}
+		return []plane{{pix, w, w, h, 1, 1, 1, 0}}, ColorSpaceGray, nil
+	}
+	planes := make([]plane, 3)
+	for c := range planes {
+		planes[c] = plane{make([]byte, w*h), w, w, h, 1, 1, byte(c + 1), 0}
+	}
+	row := make([]byte, w*3)
+	for y := 0; y < h; y++ {
+		conv(row, b.Min.Y+y)
+		for x := 0; x < w; x++ {
+			p, i := row[x*3:], y*w+x
+			if cs == ColorSpaceRGB {
+				planes[0].pix[i], planes[1].pix[i], planes[2].pix[i] = p[0], p[1], p[2]
+			} else {
+				planes[0].pix[i], planes[1].pix[i], planes[2].pix[i] = color.RGBToYCbCr(p[0], p[1], p[2])
+			}
+		}
+	}
+	if cs == ColorSpaceRGB {
+		planes[0].id, planes[1].id, planes[2].id = 'R', 'G', 'B'
+		return planes, ColorSpaceRGB, nil
+	}
+
+	ratio := image.YCbCrSubsampleRatio420
+	if opt.UseSubsampling {
+		ratio = opt.Subsampling
+	}
+	if ratio < image.YCbCrSubsampleRatio444 || ratio > image.YCbCrSubsampleRatio410 {
+		return nil, cs, fmt.Errorf("jpeg: unknown subsampling ratio %v", ratio)
+	}
+	v, hd := util.SSR2VHDiv(ratio)
+	planes[0].hs, planes[0].vs = hd, v
+	planes[1] = downsample(planes[1].pix, w, h, hd, v, 2)
+	planes[2] = downsample(planes[2].pix, w, h, hd, v, 3)
+	return planes, ColorSpaceYCbCr, nil
+}
+
+// Planes of CMYK image, or YCCK as libjpeg makes it, with Y and K at twice the
+// resolution of chroma.
+func cmykPlanes(im *image.CMYK, ycck bool) []plane {
+	b := im.Rect
+	w, h := b.Dx(), b.Dy()
+	planes := make([]plane, 4)
+	for c := range planes {
+		planes[c] = plane{make([]byte, w*h), w, w, h, 1, 1, "CMYK"[c], 0}
+	}
+	for y := 0; y < h; y++ {
+		row := im.Pix[im.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			p, i := row[x*4:], y*w+x
+			if ycck {
+				planes[0].pix[i], planes[1].pix[i], planes[2].pix[i] = color.RGBToYCbCr(255-p[0], 255-p[1], 255-p[2])
+			} else {
+				planes[0].pix[i], planes[1].pix[i], planes[2].pix[i] = p[0], p[1], p[2]
+			}
+			planes[3].pix[i] = p[3]
+		}
+	}
+	if ycck {
+		planes[0] = plane{planes[0].pix, w, w, h, 2, 2, 1, 0}
+		planes[1] = downsample(planes[1].pix, w, h, 2, 2, 2)
+		planes[2] = downsample(planes[2].pix, w, h, 2, 2, 3)
+		planes[3] = plane{planes[3].pix, w, w, h, 2, 2, 4, 0}
+	}
+	return planes
+}
+
+// Planes of YCbCr image, as they are.
+func yccPlanes(im *image.YCbCr) ([]plane, error) {
+	ratio := im.SubsampleRatio
+	if ratio < image.YCbCrSubsampleRatio444 || ratio > image.YCbCrSubsampleRatio410 {
+		return nil, fmt.Errorf("jpeg: unknown subsampling ratio %v", ratio)
+	}
+	v, h := util.SSR2VHDiv(ratio)
+	b := im.Rect
+	cw, ch := (b.Dx()+h-1)/h, (b.Dy()+v-1)/v
+	cb, cr, cs := util.AlignedChroma(im)
+	return []plane{
+		{im.Y[im.YOffset(b.Min.X, b.Min.Y):], im.YStride, b.Dx(), b.Dy(), h, v, 1, 0},
+		{cb, cs, cw, ch, 1, 1, 2, 1},
+		{cr, cs, cw, ch, 1, 1, 3, 1},
+	}, nil
+}
+
+// Average full resolution chroma over h×v boxes.
+func downsample(pix []byte, w, h, hd, v int, id byte) plane {
+	cw, ch := (w+hd-1)/hd, (h+v-1)/v
+	res := make([]byte, cw*ch)
+	for y := 0; y < ch; y++ {
+		for x := 0; x < cw; x++ {
+			sum, n := 0, 0
+			for sy := y * v; sy < y*v+v && sy < h; sy++ {
+				for sx := x * hd; sx < x*hd+hd && sx < w; sx++ {
+					sum += int(pix[sy*w+sx])
+					n++
+				}
+			}
+			res[y*cw+x] = byte((sum + n/2) / n)
+		}
+	}
+	return plane{res, cw, cw, ch, 1, 1, id, 1}
+}
+
+// Write headers and baseline scan of planes.
+func writeFile(out []byte, size image.Point, planes []plane, cs ColorSpace, opt *Options) ([]byte, error) {
+	if size.X > 0xffff || size.Y > 0xffff {
+		return nil, fmt.Errorf("jpeg: image of %v too big", size)
+	}
+	segment := func(code byte, data ...[]byte) {
+		n := 2
+		for _, d := range data {
+			n += len(d)
+		}
+		out = append(out, 0xff, code, byte(n>>8), byte(n))
+		for _, d := range data {
+			out = append(out, d...)
+		}
+	}
+	out = append(out, 0xff, 0xd8)
+	switch cs {
+	case ColorSpaceRGB, ColorSpaceCMYK, ColorSpaceYCCK:
+		if d := opt.Density; d.X > 0 && d.Y > 0 {
+			return nil, fmt.Errorf("jpeg: density needs JFIF header, not written for %v", cs)
+		}
+		transform := byte(0)
+		if cs == ColorSpaceYCCK {
+			transform = 2
+		}
+		segment(MarkerAPP14, []byte{'A', 'd', 'o', 'b', 'e', 0, 0x64, 0, 0, 0, 0, transform})
+	default:
+		d := opt.Density
+		if d.X <= 0 || d.Y <= 0 {
+			d = Density{DensityNone, 1, 1}
+		}
+		if d.Unit < DensityNone || d.Unit > DensityCm || d.X > 0xffff || d.Y > 0xffff {
+			return nil, fmt.Errorf("jpeg: invalid density %+v", d)
+		}
+		segment(MarkerAPP0, []byte{'J', 'F', 'I', 'F', 0, 1, 1, byte(d.Unit), byte(d.X >> 8), byte(d.X), byte(d.Y >> 8), byte(d.Y), 0, 0})
+	}
+	for _, m := range opt.Markers {
+		if (m.Code < MarkerAPP0 || m.Code > MarkerAPP15) && m.Code != MarkerCOM {
+			return nil, fmt.Errorf("jpeg: can't write marker 0x%02x", m.Code)
+		}
+		if len(m.Data) > MaxMarkerLen {
+			return nil, fmt.Errorf("jpeg: marker 0x%02x too long, %d bytes", m.Code, len(m.Data))
+		}
+		segment(m.Code, m.Data)
+	}
+
+	// Tables, luma and chroma, or just one.
+	ntables := 1
+	for _, p := range planes {
+		if int(p.table) >= ntables {
+			ntables = int(p.table) + 1
+		}
+	}
+	quality := opt.Quality
+	if quality <= 0 {
+		quality = 75
+	}
+	var quant [2][64]uint16
+	var dqt []byte
+	for t := 0; t < ntables; t++ {
+		if opt.QuantTables != nil {
+			// Scaled like jpeg_add_quant_table does it.
+			for i, v := range opt.QuantTables[t] {
+				quant[t][i] = uint16(math.Max(1, math.Min(255, float64((int(v)*opt.Quality+50)/100))))
+			}
+		} else {
+			quant[t] = scaleTable(&stdQuant[t], quality, 255)
+		}
+		dqt = append(dqt, byte(t))
+		for _, k := range zigzag {
+			dqt = append(dqt, byte(quant[t][k]))
+		}
+	}
+	segment(0xdb, dqt)
+
+	sof := []byte{8, byte(size.Y >> 8), byte(size.Y), byte(size.X >> 8), byte(size.X), byte(len(planes))}
+	sos := []byte{byte(len(planes))}
+	hmax, vmax := 1, 1
+	for _, p := range planes {
+		sof = append(sof, p.id, byte(p.hs<<4|p.vs), p.table)
+		sos = append(sos, p.id, p.table<<4|p.table)
+		if p.hs > hmax {
+			hmax = p.hs
+		}
+		if p.vs > vmax {
+			vmax = p.vs
+		}
+	}
+	sos = append(sos, 0, 63, 0)
+	segment(0xc0, sof)
+	var dht []byte
+	for t := 0; t < ntables; t++ {
+		for ac := 0; ac < 2; ac++ {
+			s := &stdHuffSpecs[t*2+ac]
+			dht = append(append(append(dht, byte(ac<<4|t)), s.counts[:]...), s.symbols...)
+		}
+	}
+	segment(0xc4, dht)
+	segment(0xda, sos)
+
+	// MCUs of all components interleaved, or single blocks of gray.
+	if len(planes) == 1 {
+		planes[0].hs, planes[0].vs = 1, 1
+		hmax, vmax = 1, 1
+	}
+	bw := &bitWriter{out: out}
+	pred := make([]int32, len(planes))
+	var block [64]float32
+	for my := 0; my < (size.Y+vmax*8-1)/(vmax*8); my++ {
+		for mx := 0; mx < (size.X+hmax*8-1)/(hmax*8); mx++ {
+			for c := range planes {
+				p := &planes[c]
+				dc, ac := &stdHuff[p.table*2], &stdHuff[p.table*2+1]
+				for by := 0; by < p.vs; by++ {
+					for bx := 0; bx < p.hs; bx++ {
+						x0, y0 := (mx*p.hs+bx)*8, (my*p.vs+by)*8
+						for y := 0; y < 8; y++ {
+							sy := y0 + y
+							if sy >= p.h {
+								sy = p.h - 1
+							}
+							row := p.pix[sy*p.stride:]
+							for x := 0; x < 8; x++ {
+								sx := x0 + x
+								if sx >= p.w {
+									sx = p.w - 1
+								}
+								block[y*8+x] = float32(row[sx]) - 128
+							}
+						}
+						dct8x8(&block, false)
+						q := &quant[p.table]
+
+						v := int32(math.Round(float64(block[0] / float32(q[0]))))
+						diff := v - pred[c]
+						pred[c] = v
+						n := bitLen(diff)
+						bw.emitValue(dc, byte(n), diff, n)
+						run := 0
+						for k := 1; k < 64; k++ {
+							z := zigzag[k]
+							v := int32(math.Round(float64(block[z] / float32(q[z]))))
+							if v == 0 {
+								run++
+								continue
+							}
+							for ; run > 15; run -= 16 {
+								bw.emitValue(ac, 0xf0, 0, 0)
+							}
+							n := bitLen(v)
+							bw.emitValue(ac, byte(run<<4)|byte(n), v, n)
+							run = 0
+						}
+						if run > 0 {
+							bw.emitValue(ac, 0, 0, 0)
+						}
+					}
+				}
+			}
+		}
+	}
+	if bw.nbits > 0 {
+		bw.emit(1<<(8-bw.nbits)-1, 8-bw.nbits) // Pad with ones
+	}
+	return append(bw.out, 0xff, 0xd9), nil
+}
@@ -0,0 +1,209 @@
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ezdiy/image/mpf"
+	"github.com/ezdiy/image/xmp"
+	"image"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+const (
+	NsGainMap   = "http://ns.adobe.com/hdr-gain-map/1.0/"
+	nsContainer = "http://ns.google.com/photos/1.0/container/"
+	nsItem      = "http://ns.google.com/photos/1.0/container/item/"
+)
+
+var ErrNoGainMap = errors.New("jpeg: no gain map")
+
+// HDR gain map metadata, as stored in XMP of the gain map image (Ultra HDR, Adobe).
+// Boosts and capacities are log2, and apply to all channels alike.
+type GainMap struct {
+	Min, Max                 float64 // Content boost range
+	Gamma                    float64 // Of the gain map encoding. 0 means 1.
+	OffsetSDR, OffsetHDR     float64 // Added to avoid division by zero, usually 1/64
+	CapacityMin, CapacityMax float64 // Display HDR capacity range where the map applies
+	BaseIsHDR                bool    // Primary image is the HDR rendition
+}
+
+func (g *GainMap) fields() []*float64 {
+	return []*float64{&g.Min, &g.Max, &g.Gamma, &g.OffsetSDR, &g.OffsetHDR, &g.CapacityMin, &g.CapacityMax}
+}
+
+var gainMapNames = []string{"GainMapMin", "GainMapMax", "Gamma", "OffsetSDR", "OffsetHDR", "HDRCapacityMin", "HDRCapacityMax"}
+
+// XMP packet of the gain map image.
+func (g *GainMap) packet() (*xmp.Packet, error) {
+	p := xmp.New()
+	gm := *g
+	if gm.Gamma == 0 {
+		gm.Gamma = 1
+	}
+	base := "False"
+	if gm.BaseIsHDR {
+		base = "True"
+	}
+	if err := p.Set(NsGainMap, "Version", "1.0"); err != nil {
+		return nil, err
+	}
+	for i, f := range gm.fields() {
+		if err := p.Set(NsGainMap, gainMapNames[i], strconv.FormatFloat(*f, 'f', -1, 64)); err != nil {
+			return nil, err
+		}
+	}
+	return p, p.Set(NsGainMap, "BaseRenditionIsHDR", base)
+}
+
+// Read gain map metadata from XMP of the gain map image.
+func parseGainMap(p *xmp.Packet) (*GainMap, error) {
+	if _, ok := p.Get(NsGainMap, "Version"); !ok {
+		return nil, ErrNoGainMap
+	}
+	g := &GainMap{Gamma: 1}
+	for i, f := range g.fields() {
+		if v, ok := p.Get(NsGainMap, gainMapNames[i]); ok {
+			var err error
+			if *f, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("jpeg: bad gain map %s: %v", gainMapNames[i], err)
+			}
+		}
+	}
+	v, _ := p.Get(NsGainMap, "BaseRenditionIsHDR")
+	g.BaseIsHDR = v == "True"
+	return g, nil
+}
+
+// Decode all images of a multi-picture (MPF) file, in index order. Files without
+// MPF index decode as a single image, and nil index. Output fields of opt, such as
+// Markers, describe the last image decoded.
+func DecodePictures(r io.Reader, opt *DecoderOptions) (imgs []image.Image, ix *mpf.Index, err error) {
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	ix, streams, err := mpf.Split(file)
+	if err == mpf.ErrNotFound {
+		streams, err = [][]byte{file}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range streams {
+		img, err := DecodeImage(bytes.NewReader(s), opt)
+		if err != nil {
+			return nil, nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, ix, nil
+}
+
+// Decode primary image of Ultra HDR file, along with its gain map.
+func DecodeGainMap(r io.Reader, opt *DecoderOptions) (primary, gainMap image.Image, meta *GainMap, err error) {
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	_, streams, err := mpf.Split(file)
+	if err == mpf.ErrNotFound {
+		err = ErrNoGainMap
+	}
+	if err != nil {
+		return
+	}
+	for _, s := range streams[1:] {
+		if p, perr := xmp.ReadJPEG(bytes.NewReader(s)); perr == nil {
+			if meta, perr = parseGainMap(p); perr != ErrNoGainMap {
+				if err = perr; err != nil {
+					return
+				}
+				if primary, err = DecodeImage(bytes.NewReader(streams[0]), opt); err != nil {
+					return
+				}
+				gainMap, err = DecodeImage(bytes.NewReader(s), opt)
+				return
+			}
+		}
+	}
+	return nil, nil, nil, ErrNoGainMap
+}
+
+// Encode primary image with a gain map, as Ultra HDR file. XMP found in opt.Markers
+// is extended with the container directory. NBWritten isn't filled.
+func EncodeGainMap(w io.Writer, primary, gainMap image.Image, meta *GainMap, opt *Options) error {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	o.NBWritten = nil
+
+	// Gain map goes first, as primary XMP needs its length.
+	gp, err := meta.packet()
+	if err != nil {
+		return err
+	}
+	gm, err := encodeWithXMP(gainMap, gp, Options{
+		Quality: o.Quality, DCTMethod: o.DCTMethod, Ext: o.Ext,
+		GrayFuzz: o.GrayFuzz, Alpha: o.Alpha, Background: o.Background,
+	})
+	if err != nil {
+		return err
+	}
+
+	p, err := xmp.Decode(o.Markers.Payloads(MarkerAPP1))
+	if err == xmp.ErrNotFound {
+		p, err = xmp.New(), nil
+	}
+	if err != nil {
+		return err
+	}
+	p.Delete(nsContainer, "Directory")
+	if err = p.Set(NsGainMap, "Version", "1.0"); err != nil {
+		return err
+	}
+	err = p.AddDescription(fmt.Sprintf(`<rdf:Description rdf:about=""`+
+		` xmlns:rdf="%s" xmlns:Container="%s" xmlns:Item="%s"><Container:Directory><rdf:Seq>`+
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Primary" Item:Mime="image/jpeg"/></rdf:li>`+
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="GainMap" Item:Mime="image/jpeg" Item:Length="%d"/></rdf:li>`+
+		`</rdf:Seq></Container:Directory></rdf:Description>`, xmp.NsRDF, nsContainer, nsItem, len(gm)))
+	if err != nil {
+		return err
+	}
+	pb, err := encodeWithXMP(primary, p, o)
+	if err != nil {
+		return err
+	}
+	ix := &mpf.Index{Entries: []mpf.Entry{{Type: mpf.Primary, Flags: mpf.Representative}, {Type: mpf.Undefined}}}
+	return mpf.Write(w, ix, [][]byte{pb, gm})
+}
+
+// Encode image into memory, with XMP replacing any found in options.
+func encodeWithXMP(img image.Image, p *xmp.Packet, o Options) ([]byte, error) {
+	app1, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	var markers Markers
+	for _, m := range o.Markers {
+		if m.Code == MarkerAPP1 && (bytes.HasPrefix(m.Data, xmp.Header) || bytes.HasPrefix(m.Data, xmp.ExtendedHeader)) {
+			continue
+		}
+		if m.Code == MarkerAPP2 && bytes.HasPrefix(m.Data, mpf.Header) {
+			continue
+		}
+		markers = append(markers, m)
+	}
+	for _, b := range app1 {
+		markers = append(markers, Marker{MarkerAPP1, b})
+	}
+	o.Markers = markers
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &o); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,287 @@
+package jpeg
+
+import (
+	"encoding/binary"
+	"github.com/ezdiy/image/util"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// Coding process of a frame, from its SOF marker.
+type FrameType int
+
+const (
+	FrameBaseline    FrameType = iota // SOF0
+	FrameExtended                     // Extended sequential, SOF1, SOF5, SOF9, SOF13
+	FrameProgressive                  // SOF2, SOF6, SOF10, SOF14
+	FrameLossless                     // SOF3, SOF7, SOF11, SOF15
+)
+
+var frameNames = []string{"baseline", "extended", "progressive", "lossless"}
+
+func (f FrameType) String() string {
+	if f < 0 || int(f) >= len(frameNames) {
+		return "unknown"
+	}
+	return frameNames[f]
+}
+
+// Component of a frame.
+type ComponentInfo struct {
+	ID         byte
+	H, V       int // Sampling factors
+	QuantTable int
+}
+
+// Component of a scan.
+type ScanComponent struct {
+	ID               byte
+	DCTable, ACTable int
+}
+
+// Scan header, and where its entropy coded data is.
+type ScanInfo struct {
+	Components      []ScanComponent
+	Ss, Se          int // Spectral selection
+	Ah, Al          int // Successive approximation
+	RestartInterval int // In effect for this scan, 0 if none
+	Offset, Length  int // Entropy coded data, including RSTn markers
+}
+
+// Quantization table, as defined by DQT.
+type QuantTable struct {
+	Index     int
+	Precision int        // 8 or 16 bits
+	Values    [64]uint16 // Natural (not zigzag) order
+}
+
+// Huffman table, as defined by DHT.
+type HuffmanTable struct {
+	AC      bool // DC otherwise
+	Index   int
+	Counts  [16]byte // Number of codes of each length
+	Symbols []byte
+}
+
+// Marker in the file. RSTn markers inside scans aren't listed.
+type MarkerInfo struct {
+	Code   byte // Without the 0xff prefix
+	Offset int  // Of the 0xff
+	Length int  // Whole segment, including marker and length
+}
+
+// Structure of JPEG file, as returned by Inspect.
+type Info struct {
+	SOF          byte // Frame marker code, 0xc0 to 0xcf
+	Type         FrameType
+	Arithmetic   bool // Arithmetic coding, Huffman otherwise
+	Differential bool // Hierarchical file
+	Precision    int  // Bits per sample
+	Size         image.Point
+	Components   []ComponentInfo
+
+	RestartInterval int // In effect for the first scan, 0 if none
+	Scans           []ScanInfo
+
+	// Table definitions in file order. Progressive files often redefine them
+	// between scans.
+	QuantTables   []QuantTable
+	HuffmanTables []HuffmanTable
+
+	Markers  []MarkerInfo
+	Trailing int // Bytes after EOI
+}
+
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Describe structure of JPEG stream without decoding it, down to its EOI. Doesn't
+// need libjpeg. Whatever was parsed is returned even on error; io.ErrUnexpectedEOF
+// means the stream ends before EOI.
+func Inspect(r io.Reader) (*Info, error) {
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{}
+	return info, info.parse(in)
+}
+
+func (info *Info) parse(in []byte) error {
+	if len(in) < 2 || in[0] != 0xff || in[1] != 0xd8 {
+		return util.ErrNotJPEG
+	}
+	info.Markers = append(info.Markers, MarkerInfo{0xd8, 0, 2})
+	restart := 0
+	for pos := 2; ; {
+		if pos+2 > len(in) {
+			return io.ErrUnexpectedEOF
+		}
+		if in[pos] != 0xff {
+			return errSegments
+		}
+		code := in[pos+1]
+		if code == 0xff {
+			pos++ // Fill byte
+			continue
+		}
+		switch {
+		case code == 0xd9:
+			info.Markers = append(info.Markers, MarkerInfo{code, pos, 2})
+			info.Trailing = len(in) - pos - 2
+			return nil
+		case code == 0x01 || (code >= 0xd0 && code <= 0xd7):
+			info.Markers = append(info.Markers, MarkerInfo{code, pos, 2})
+			pos += 2
+			continue
+		case code == 0xd8 || code == 0:
+			return errSegments
+		}
+		if pos+4 > len(in) {
+			return io.ErrUnexpectedEOF
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(in[pos+2:]))
+		if end < pos+4 {
+			return errSegments
+		}
+		if end > len(in) {
+			return io.ErrUnexpectedEOF
+		}
+		info.Markers = append(info.Markers, MarkerInfo{code, pos, end - pos})
+		data := in[pos+4 : end]
+		pos = end
+
+		var ok bool
+		switch {
+		case code == 0xc4:
+			ok = info.parseDHT(data)
+		case code == 0xdb:
+			ok = info.parseDQT(data)
+		case code == 0xdd:
+			if ok = len(data) == 2; ok {
+				restart = int(binary.BigEndian.Uint16(data))
+			}
+		case code == 0xdc: // DNL
+			if ok = len(data) == 2; ok && info.Size.Y == 0 {
+				info.Size.Y = int(binary.BigEndian.Uint16(data))
+			}
+		case code == 0xda:
+			if ok = info.parseSOS(data, restart); ok {
+				// Entropy coded data runs up to the next marker other than RSTn.
+				scan := &info.Scans[len(info.Scans)-1]
+				scan.Offset = pos
+				for ; pos+1 < len(in); pos++ {
+					if c := in[pos+1]; in[pos] == 0xff && c != 0 && !(c >= 0xd0 && c <= 0xd7) {
+						break
+					}
+				}
+				if pos+1 >= len(in) {
+					pos = len(in)
+				}
+				scan.Length = pos - scan.Offset
+			}
+		case code >= 0xc0 && code <= 0xcf && code != 0xc8 && code != 0xcc:
+			ok = info.parseSOF(code, data)
+		default:
+			ok = true // APPn, COM, DAC and friends
+		}
+		if !ok {
+			return errSegments
+		}
+	}
+}
+
+func (info *Info) parseSOF(code byte, data []byte) bool {
+	if info.Components != nil || len(data) < 6 || len(data) != 6+3*int(data[5]) {
+		return false
+	}
+	info.SOF = code
+	info.Type = FrameType(code & 3)
+	if code != 0xc0 && info.Type == FrameBaseline {
+		info.Type = FrameExtended
+	}
+	info.Arithmetic = code&8 != 0
+	info.Differential = code&4 != 0
+	info.Precision = int(data[0])
+	info.Size = image.Pt(int(binary.BigEndian.Uint16(data[3:])), int(binary.BigEndian.Uint16(data[1:])))
+	info.Components = []ComponentInfo{}
+	for c := data[6:]; len(c) > 0; c = c[3:] {
+		comp := ComponentInfo{ID: c[0], H: int(c[1] >> 4), V: int(c[1] & 15), QuantTable: int(c[2])}
+		if comp.H < 1 || comp.H > 4 || comp.V < 1 || comp.V > 4 {
+			return false
+		}
+		info.Components = append(info.Components, comp)
+	}
+	return true
+}
+
+func (info *Info) parseSOS(data []byte, restart int) bool {
+	if len(data) < 1 || len(data) != 4+2*int(data[0]) {
+		return false
+	}
+	if len(info.Scans) == 0 {
+		info.RestartInterval = restart
+	}
+	scan := ScanInfo{RestartInterval: restart}
+	n := int(data[0])
+	for c := data[1 : 1+2*n]; len(c) > 0; c = c[2:] {
+		scan.Components = append(scan.Components, ScanComponent{ID: c[0], DCTable: int(c[1] >> 4), ACTable: int(c[1] & 15)})
+	}
+	p := data[1+2*n:]
+	scan.Ss, scan.Se, scan.Ah, scan.Al = int(p[0]), int(p[1]), int(p[2]>>4), int(p[2]&15)
+	info.Scans = append(info.Scans, scan)
+	return true
+}
+
+func (info *Info) parseDQT(data []byte) bool {
+	for len(data) > 0 {
+		t := QuantTable{Index: int(data[0] & 15), Precision: 8}
+		n := 65
+		if data[0]>>4 != 0 {
+			t.Precision, n = 16, 129
+		}
+		if len(data) < n {
+			return false
+		}
+		for i, z := range zigzag {
+			if t.Precision == 8 {
+				t.Values[z] = uint16(data[1+i])
+			} else {
+				t.Values[z] = binary.BigEndian.Uint16(data[1+2*i:])
+			}
+		}
+		info.QuantTables = append(info.QuantTables, t)
+		data = data[n:]
+	}
+	return true
+}
+
+func (info *Info) parseDHT(data []byte) bool {
+	for len(data) > 0 {
+		if len(data) < 17 {
+			return false
+		}
+		t := HuffmanTable{AC: data[0]>>4 != 0, Index: int(data[0] & 15)}
+		n := 0
+		for i := range t.Counts {
+			t.Counts[i] = data[1+i]
+			n += int(data[1+i])
+		}
+		if len(data) < 17+n {
+			return false
+		}
+		t.Symbols = append([]byte(nil), data[17:17+n]...)
+		info.HuffmanTables = append(info.HuffmanTables, t)
+		data = data[17+n:]
+	}
+	return true
+}
@@ -3,37 +3,659 @@
 package jpeg
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ezdiy/image/util"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"io"
+	"io/ioutil"
+	"runtime"
 )
 
-// That feel when no cgo.
+// That feel when no cgo. Files are decoded by image/jpeg, with the options applied on
+// top, and encoded by the baseline encoder in encoder_generic.go. What only libjpeg
+// can do fails with errors wrapping ErrNoCgo.
 
-func Transform(w io.Writer, r io.Reader, o *Options) (err error) {
-	// Nothing cropped, so just pipe the image as-is.
-	if o.Rectangle == nil {
-		_, err = io.Copy(w, r)
+func errNoCgo(what string) error {
+	return fmt.Errorf("%w: %s", ErrNoCgo, what)
+}
+
+// Color space of file, as libjpeg tells it.
+type colorSpace int
+
+const (
+	csGray colorSpace = iota
+	csYCbCr
+	csRGB
+	csCMYK
+)
+
+// File read in full, with what decoding needs to know about it.
+type file struct {
+	data    []byte
+	info    Info
+	cs      colorSpace
+	markers Markers
+	jfif    []byte // JFIF APP0 payload, nil if none
+	adobe   []byte // Adobe APP14 payload, nil if none
+}
+
+// Read file from input. Bytes read from Stream past EOI are put back.
+func readFile(input io.Reader) (f *file, err error) {
+	f = &file{}
+	if s, ok := input.(*Stream); ok {
+		if f.data, err = readStream(s, &f.info); err != nil {
+			return nil, err
+		}
+	} else {
+		if f.data, err = ioutil.ReadAll(input); err != nil {
+			return nil, err
+		}
+		if len(f.data) == 0 {
+			return nil, io.EOF
+		}
+		// Truncated image data is image/jpeg's to tell.
+		if err = f.info.parse(f.data); err == io.ErrUnexpectedEOF && len(f.info.Scans) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range f.info.Markers {
+		if (m.Code < MarkerAPP0 || m.Code > MarkerAPP15) && m.Code != MarkerCOM {
+			continue
+		}
+		data := append([]byte{}, f.data[m.Offset+4:m.Offset+m.Length]...)
+		f.markers = append(f.markers, Marker{Code: m.Code, Data: data})
+		switch {
+		case f.jfif == nil && m.Code == MarkerAPP0 && len(data) >= 12 && bytes.HasPrefix(data, []byte("JFIF\x00")):
+			f.jfif = data
+		case f.adobe == nil && m.Code == MarkerAPP14 && len(data) >= 12 && bytes.HasPrefix(data, []byte("Adobe")):
+			f.adobe = data
+		}
+	}
+
+	comps := f.info.Components
+	switch len(comps) {
+	case 0:
+		return nil, util.ErrNotJPEG
+	case 1:
+		f.cs = csGray
+	case 3:
+		// Same guesswork as libjpeg.
+		f.cs = csYCbCr
+		if f.jfif == nil {
+			if f.adobe != nil && f.adobe[11] == 0 || f.adobe == nil && comps[0].ID == 'R' && comps[1].ID == 'G' && comps[2].ID == 'B' {
+				f.cs = csRGB
+			}
+		}
+	case 4:
+		f.cs = csCMYK
+	default:
+		return nil, fmt.Errorf("jpeg: can't decode %d components", len(comps))
+	}
+	return f, nil
+}
+
+var eoi = []byte{0xff, 0xd9}
+
+// Read one file of s, up to its EOI.
+func readStream(s *Stream, info *Info) ([]byte, error) {
+	var buf []byte
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, make([]byte, len(buf)+4096)...)[:len(buf)]
+		}
+		n, err := s.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		// Parse again only when EOI may have arrived.
+		from := len(buf) - n - 1
+		if from < 0 {
+			from = 0
+		}
+		if err != nil || bytes.Contains(buf[from:], eoi) {
+			*info = Info{}
+			switch perr := info.parse(buf); {
+			case perr == nil:
+				end := len(buf) - info.Trailing
+				s.unread(buf[end:])
+				return buf[:end], nil
+			case perr != io.ErrUnexpectedEOF:
+				return nil, perr
+			}
+		}
+		if err == io.EOF && len(buf) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Quantization table of component.
+func (f *file) quantTable(comp int) (*[64]uint16, error) {
+	for i := range f.info.QuantTables {
+		if t := &f.info.QuantTables[i]; t.Index == f.info.Components[comp].QuantTable {
+			return &t.Values, nil
+		}
+	}
+	return nil, fmt.Errorf("jpeg: missing quantization table")
+}
+
+// Estimate quality from quantization tables.
+func (f *file) quality() (q QualityEstimate, err error) {
+	luma, err := f.quantTable(0)
+	if err != nil {
 		return
 	}
-	// Cropping, will have to re-code.
-	i, e := Decode(r)
-	if e != nil {
-		return e
+	var chroma *[64]uint16
+	if len(f.info.Components) >= 3 {
+		if chroma, err = f.quantTable(1); err != nil {
+			return
+		}
+	}
+	return estimateQuality(luma, chroma, baseQuantTables(), f.adobe != nil), nil
+}
+
+// Subsampling ratio of 3 component file, if image.YCbCr can represent it.
+func (f *file) subsampling() image.YCbCrSubsampleRatio {
+	c := f.info.Components
+	if len(c) != 3 || c[2].V != c[1].V || c[2].H != c[1].H || c[0].V%c[1].V != 0 || c[0].H%c[1].H != 0 {
+		return util.YCbCrSubsampleRatioUnknown
+	}
+	return util.VHDiv2SSR(c[0].V/c[1].V, c[0].H/c[1].H)
+}
+
+// Fill outputs of options which don't need decoding.
+func (f *file) readHeader(opt *DecoderOptions) (err error) {
+	if opt.NBRead != nil {
+		*opt.NBRead += len(f.data)
+	}
+	if opt.Markers != nil {
+		*opt.Markers = append(Markers{}, f.markers...)
+	}
+	if opt.Density != nil {
+		*opt.Density = Density{}
+		if d := f.jfif; d != nil {
+			*opt.Density = Density{
+				Unit: DensityUnit(d[7]),
+				X:    int(binary.BigEndian.Uint16(d[8:])),
+				Y:    int(binary.BigEndian.Uint16(d[10:])),
+			}
+		}
+	}
+	if opt.Quality != nil {
+		*opt.Quality, err = f.quality()
+	}
+	if config := opt.Config; config != nil && err == nil {
+		config.ColorModel = [...]color.Model{
+			csGray:  color.GrayModel,
+			csYCbCr: color.YCbCrModel,
+			csRGB:   color.NRGBAModel,
+			csCMYK:  color.CMYKModel,
+		}[f.cs]
+		config.Width, config.Height = f.info.Size.X, f.info.Size.Y
+	}
+	return
+}
+
+// Decode file, coercing it into one of the models options allow, as libjpeg does.
+func (f *file) decode(opt *DecoderOptions) (image.Image, error) {
+	if opt == nil {
+		opt = &DefaultDecoderOptions
+	}
+	if err := f.readHeader(opt); err != nil || opt.Config != nil {
+		return nil, err
+	}
+	switch {
+	case f.info.Arithmetic:
+		return nil, errNoCgo("arithmetic coding")
+	case opt.Deblock != nil:
+		return nil, errNoCgo("Deblock")
+	}
+	src, err := jpeg.Decode(bytes.NewReader(f.data))
+	if err != nil {
+		return nil, err
+	}
+	if im, ok := src.(*image.CMYK); ok {
+		// image/jpeg inverts Adobe CMYK, libjpeg leaves it be.
+		for i, v := range im.Pix {
+			im.Pix[i] = 255 - v
+		}
+	}
+
+	denom := scaleDenom(src.Bounds().Size(), opt.ScaleTo)
+	if opt.Quantize != nil {
+		return quantize(src, denom, f.cs, opt.Quantize)
+	}
+	var models []color.Model
+	switch f.cs {
+	case csGray:
+		models = []color.Model{color.GrayModel, color.NRGBAModel, color.RGBAModel}
+	case csYCbCr:
+		if ycc, ok := src.(*image.YCbCr); ok && denom == 1 && opt.HasModel(color.YCbCrModel) && opt.HasSSR(ycc.SubsampleRatio) {
+			return ycc, nil
+		}
+		models = []color.Model{color.NRGBAModel, color.RGBAModel, color.GrayModel}
+	case csRGB:
+		models = []color.Model{color.NRGBAModel, color.RGBAModel, color.GrayModel}
+	case csCMYK:
+		models = []color.Model{color.CMYKModel}
+	}
+	for _, m := range models {
+		if opt.HasModel(m) {
+			return scaleDown(toModel(src, m), denom), nil
+		}
+	}
+	return nil, nil
+}
+
+// Convert decoded image to model, gray being the luma of YCbCr like with libjpeg.
+func toModel(img image.Image, m color.Model) image.Image {
+	if ycc, ok := img.(*image.YCbCr); ok && m == color.GrayModel {
+		return &image.Gray{Pix: ycc.Y, Stride: ycc.YStride, Rect: ycc.Rect}
+	}
+	return util.ToModel(img, m)
+}
+
+// Largest DCT scaling denominator libjpeg would pick to keep the image at least min big.
+func scaleDenom(size, min image.Point) int {
+	denom := 1
+	if min != (image.Point{}) {
+		for denom < 8 && (size.X+denom*2-1)/(denom*2) >= min.X && (size.Y+denom*2-1)/(denom*2) >= min.Y {
+			denom *= 2
+		}
+	}
+	return denom
+}
+
+// Box filter img of Gray, RGBA, NRGBA or CMYK model down by denom, in place of DCT
+// scaling.
+func scaleDown(img image.Image, denom int) image.Image {
+	if denom == 1 {
+		return img
+	}
+	ncomp := 4
+	if img.ColorModel() == color.GrayModel {
+		ncomp = 1
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	res := util.NewImage(img.ColorModel(), image.Rect(0, 0, (w+denom-1)/denom, (h+denom-1)/denom))
+	src, stride := util.GetPixStride(img)
+	dst, dstride := util.GetPixStride(res)
+	for y := 0; y < res.Bounds().Dy(); y++ {
+		for x := 0; x < res.Bounds().Dx(); x++ {
+			for c := 0; c < ncomp; c++ {
+				sum, n := 0, 0
+				for sy := y * denom; sy < y*denom+denom && sy < h; sy++ {
+					for sx := x * denom; sx < x*denom+denom && sx < w; sx++ {
+						sum += int(src[sy*stride+sx*ncomp+c])
+						n++
+					}
+				}
+				dst[y*dstride+x*ncomp+c] = byte((sum + n/2) / n)
+			}
+		}
+	}
+	return res
+}
+
+// Reduce colors with draw, into palette of q or one made up like libjpeg would.
+func quantize(src image.Image, denom int, cs colorSpace, q *Quantize) (image.Image, error) {
+	switch {
+	case q.Dither < DitherFS || q.Dither > DitherNone:
+		return nil, fmt.Errorf("jpeg: unknown dither mode %d", int(q.Dither))
+	case q.Dither == DitherOrdered:
+		return nil, errNoCgo("ordered dithering")
+	case cs == csCMYK:
+		return nil, errNoCgo("quantizing CMYK")
+	case len(q.Palette) > 256:
+		return nil, fmt.Errorf("jpeg: palette of %d colors", len(q.Palette))
+	}
+	pal := q.Palette
+	gray := cs == csGray && len(pal) == 0
+	if gray {
+		src = scaleDown(toModel(src, color.GrayModel), denom)
+	} else {
+		src = scaleDown(toModel(src, color.RGBAModel), denom)
+	}
+	if len(pal) == 0 {
+		n, min := q.Colors, 8
+		if n <= 0 {
+			n = 256
+		}
+		if gray {
+			min = 2
+		}
+		if n < min || n > 256 {
+			return nil, fmt.Errorf("jpeg: can't quantize to %d colors", n)
+		}
+		switch {
+		case gray:
+			pal = grayPalette(n)
+		case q.OnePass:
+			pal = uniformPalette(n)
+		default:
+			pal = medianCut(src.(*image.RGBA), n)
+		}
+	}
+
+	img := image.NewPaletted(src.Bounds(), pal)
+	var d draw.Drawer = draw.FloydSteinberg
+	if q.Dither == DitherNone {
+		d = draw.Src
+	}
+	d.Draw(img, img.Rect, src, image.Point{})
+	return img, nil
+}
+
+// Evenly spaced levels of gray.
+func grayPalette(n int) color.Palette {
+	pal := make(color.Palette, n)
+	for i := range pal {
+		pal[i] = color.Gray{uint8((i*255 + (n-1)/2) / (n - 1))}
+	}
+	return pal
+}
+
+// Color cube of at most n colors, with levels added to green first, then red, then
+// blue, as in libjpeg one pass quantization.
+func uniformPalette(n int) color.Palette {
+	base := 2
+	for (base+1)*(base+1)*(base+1) <= n {
+		base++
+	}
+	levels := [3]int{base, base, base}
+	for changed := true; changed; {
+		changed = false
+		for _, c := range [3]int{1, 0, 2} {
+			if levels[0]*levels[1]*levels[2]/levels[c]*(levels[c]+1) > n {
+				break
+			}
+			levels[c]++
+			changed = true
+		}
+	}
+	level := func(i, c int) uint8 {
+		return uint8((i*255 + (levels[c]-1)/2) / (levels[c] - 1))
 	}
-	return Encode(w, i, o)
+	var pal color.Palette
+	for r := 0; r < levels[0]; r++ {
+		for g := 0; g < levels[1]; g++ {
+			for b := 0; b < levels[2]; b++ {
+				pal = append(pal, color.RGBA{level(r, 0), level(g, 1), level(b, 2), 0xff})
+			}
+		}
+	}
+	return pal
 }
 
-func Encode(w io.Writer, m image.Image, o *Options) error {
-	return jpeg.Encode(w, m, o)
+// Box of colors in the histogram of medianCut.
+type cutBox struct {
+	lo, hi [3]int // Inclusive, in histogram cells
+	pop    uint64
 }
 
+// Pick up to n colors of img by median cut of its histogram, with 5 bits per channel
+// like libjpeg two pass quantization does.
+func medianCut(img *image.RGBA, n int) color.Palette {
+	hist := make([]uint64, 1<<15)
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := img.Pix[i:]
+		hist[int(p[0]>>3)<<10|int(p[1]>>3)<<5|int(p[2]>>3)]++
+	}
+	each := func(b *cutBox, fn func(c [3]int, n uint64)) {
+		for r := b.lo[0]; r <= b.hi[0]; r++ {
+			for g := b.lo[1]; g <= b.hi[1]; g++ {
+				for bl := b.lo[2]; bl <= b.hi[2]; bl++ {
+					if n := hist[r<<10|g<<5|bl]; n > 0 {
+						fn([3]int{r, g, bl}, n)
+					}
+				}
+			}
+		}
+	}
+	// Shrink box to the colors inside.
+	fit := func(b *cutBox) {
+		lo, hi := [3]int{31, 31, 31}, [3]int{}
+		b.pop = 0
+		each(b, func(c [3]int, n uint64) {
+			b.pop += n
+			for a, v := range c {
+				if v < lo[a] {
+					lo[a] = v
+				}
+				if v > hi[a] {
+					hi[a] = v
+				}
+			}
+		})
+		b.lo, b.hi = lo, hi
+	}
+
+	boxes := []cutBox{{hi: [3]int{31, 31, 31}}}
+	fit(&boxes[0])
+	for len(boxes) < n {
+		// Split the most populated box along its longest side.
+		best := -1
+		for i := range boxes {
+			if b := &boxes[i]; b.lo != b.hi && (best < 0 || b.pop > boxes[best].pop) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		b := boxes[best]
+		axis := 0
+		for a := 1; a < 3; a++ {
+			if b.hi[a]-b.lo[a] > b.hi[axis]-b.lo[axis] {
+				axis = a
+			}
+		}
+		var sums [32]uint64
+		each(&b, func(c [3]int, n uint64) { sums[c[axis]] += n })
+		cut := b.lo[axis]
+		for acc := sums[cut]; cut+1 < b.hi[axis] && acc*2 < b.pop; acc += sums[cut] {
+			cut++
+		}
+		lo, hi := b, b
+		lo.hi[axis], hi.lo[axis] = cut, cut+1
+		fit(&lo)
+		fit(&hi)
+		boxes[best] = lo
+		boxes = append(boxes, hi)
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i := range boxes {
+		var sum [3]uint64
+		each(&boxes[i], func(c [3]int, n uint64) {
+			for a, v := range c {
+				sum[a] += uint64(v<<3|4) * n
+			}
+		})
+		p := boxes[i].pop
+		pal[i] = color.RGBA{uint8(sum[0] / p), uint8(sum[1] / p), uint8(sum[2] / p), 0xff}
+	}
+	return pal
+}
+
+// Decode an image with given options.
+func DecodeImage(input io.Reader, opt *DecoderOptions) (image.Image, error) {
+	f, err := readFile(input)
+	if err != nil {
+		return nil, err
+	}
+	return f.decode(opt)
+}
+
+// Decode an image held in memory.
+func DecodeBytes(data []byte, opt *DecoderOptions) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return DecodeImage(bytes.NewReader(data), opt)
+}
+
+// Compatible API to read color model and dimensions only.
+func DecodeConfig(r io.Reader) (cfg image.Config, err error) {
+	_, err = DecodeImage(r, &DecoderOptions{Config: &cfg})
+	return
+}
+
+// Compatible API, decodes with default options.
 func Decode(r io.Reader) (image.Image, error) {
-	return jpeg.Decode(r)
+	return DecodeImage(r, nil)
+}
+
+// Decode into dst of the (scaled) image size, see the cgo version. Converted with draw,
+// so rows are copied once more.
+func DecodeInto(dst draw.Image, input io.Reader, opt *DecoderOptions) error {
+	if opt == nil {
+		opt = &DefaultDecoderOptions
+	}
+	if opt.Deblock != nil {
+		return errDeblockInto
+	}
+	o := *opt
+	o.Config, o.Quantize = nil, nil
+	ncomp := 4
+	switch dst.(type) {
+	case *image.Gray:
+		o.OutputColorspaces, ncomp = []color.Model{color.GrayModel}, 1
+	case *image.RGBA, *image.NRGBA:
+		o.OutputColorspaces = []color.Model{color.NRGBAModel}
+	case *image.CMYK:
+		o.OutputColorspaces = []color.Model{color.CMYKModel}
+	default:
+		return fmt.Errorf("jpeg: can't decode into %T", dst)
+	}
+	img, err := DecodeImage(input, &o)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("jpeg: can't decode CMYK into %T", dst)
+	}
+	size := img.Bounds().Size()
+	if dst.Bounds().Size() != size {
+		return fmt.Errorf("jpeg: destination of %v, image of %v", dst.Bounds().Size(), size)
+	}
+	pix, stride := util.GetPixStride(dst)
+	if len(pix) < (size.Y-1)*stride+size.X*ncomp {
+		return fmt.Errorf("jpeg: destination buffer of %d bytes too short", len(pix))
+	}
+	src, sstride := util.GetPixStride(img)
+	for y := 0; y < size.Y; y++ {
+		copy(pix[y*stride:][:size.X*ncomp], src[y*sstride:])
+	}
+	return nil
+}
+
+// Decode YCbCr file into planes of dst, see the cgo version. Planes are checked to
+// cover whole 8x8 blocks all the same, so that what works here works with libjpeg.
+func DecodeYCbCrInto(dst *image.YCbCr, input io.Reader, opt *DecoderOptions) error {
+	if opt == nil {
+		opt = &DefaultDecoderOptions
+	}
+	if opt.Deblock != nil {
+		return errDeblockInto
+	}
+	o := *opt
+	o.Config, o.Quantize, o.ScaleTo = nil, nil, image.Point{}
+	o.OutputColorspaces, o.WhitelistedSubsampling = []color.Model{color.YCbCrModel}, nil
+	img, err := DecodeImage(input, &o)
+	if err != nil {
+		return err
+	}
+	src, ok := img.(*image.YCbCr)
+	if !ok {
+		return fmt.Errorf("jpeg: file can't be decoded into image.YCbCr")
+	}
+	if src.SubsampleRatio != dst.SubsampleRatio {
+		return fmt.Errorf("jpeg: file subsampled %v, destination %v", src.SubsampleRatio, dst.SubsampleRatio)
+	}
+	v, h := util.SSR2VHDiv(src.SubsampleRatio)
+	if dst.Rect.Min.X%h != 0 || dst.Rect.Min.Y%v != 0 {
+		return fmt.Errorf("jpeg: destination at %v not aligned to subsampling", dst.Rect.Min)
+	}
+	size := src.Rect.Size()
+	if dst.Rect.Size() != size {
+		return fmt.Errorf("jpeg: destination of %v, image of %v", dst.Rect.Size(), size)
+	}
+	// Planes must take whole blocks, as with libjpeg.
+	cw, ch := (size.X+h-1)/h, (size.Y+v-1)/v
+	yo, co := dst.YOffset(dst.Rect.Min.X, dst.Rect.Min.Y), dst.COffset(dst.Rect.Min.X, dst.Rect.Min.Y)
+	for i, p := range []struct {
+		pix          []byte
+		stride, w, h int
+	}{{dst.Y[yo:], dst.YStride, size.X, size.Y}, {dst.Cb[co:], dst.CStride, cw, ch}, {dst.Cr[co:], dst.CStride, cw, ch}} {
+		w, h := (p.w+7)&^7, (p.h+7)&^7
+		if p.stride < w || len(p.pix) < (h-1)*p.stride+w {
+			return fmt.Errorf("jpeg: plane %d of stride %d and %d bytes, need %dx%d blocks", i, p.stride, len(p.pix), w/8, h/8)
+		}
+	}
+	for y := 0; y < size.Y; y++ {
+		copy(dst.Y[yo+y*dst.YStride:][:size.X], src.Y[y*src.YStride:])
+	}
+	for y := 0; y < ch; y++ {
+		copy(dst.Cb[co+y*dst.CStride:][:cw], src.Cb[y*src.CStride:])
+		copy(dst.Cr[co+y*dst.CStride:][:cw], src.Cr[y*src.CStride:])
+	}
+	return nil
+}
+
+// Header details, for Transcode.
+type header struct {
+	size        image.Point
+	quality     QualityEstimate
+	progressive bool
+	ratio       image.YCbCrSubsampleRatio // Unknown if not YCbCr
+	markers     Markers
+}
+
+// Read header of JPEG stream.
+func probe(input io.Reader) (h header, err error) {
+	f, err := readFile(input)
+	if err != nil {
+		return
+	}
+	if h.quality, err = f.quality(); err != nil {
+		return
+	}
+	h.size = f.info.Size
+	h.progressive = f.info.Type == FrameProgressive
+	h.ratio = util.YCbCrSubsampleRatioUnknown
+	if f.cs == csYCbCr {
+		h.ratio = f.subsampling()
+	}
+	h.markers = f.markers
+	return
+}
+
+// Lossless rewrite needs DCT coefficients, which image/jpeg doesn't give out.
+func Optimize(w io.Writer, r io.Reader, opt *Options) error {
+	return errNoCgo("Optimize")
+}
+
+// Only the IJG tables are known without the library.
+func baseQuantTables() [][2][64]uint16 {
+	return [][2][64]uint16{stdQuant}
 }
 
-func DecodeConfig(r io.Reader) (image.Config, error) {
-	return jpeg.DecodeConfig(r)
+// Report the codec in use, which is image/jpeg of the Go runtime.
+func Capabilities() Features {
+	return Features{Library: "image/jpeg", Version: runtime.Version()}
 }
 
-// no need to register image format as the import of image/jpeg does that already
+// No need to register image format as the import of image/jpeg does that already.
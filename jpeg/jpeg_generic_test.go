@@ -0,0 +1,99 @@
+//+build !cgo
+
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestNoCgo(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(img)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	on := true
+	for _, opt := range []Options{
+		{ArithmeticCoding: true},
+		{SmoothingFactor: 10},
+		{Ext: ExtOptions{Trellis: &on}},
+		{Ext: ExtOptions{Profile: ProfileMaxCompression}},
+	} {
+		if err := Encode(&buf, img, &opt); !errors.Is(err, ErrNoCgo) {
+			t.Fatalf("%+v: expected ErrNoCgo, got %v", opt, err)
+		}
+	}
+	if err := Optimize(&buf, bytes.NewReader(file), nil); !errors.Is(err, ErrNoCgo) {
+		t.Fatalf("Optimize: expected ErrNoCgo, got %v", err)
+	}
+	for _, opt := range []DecoderOptions{
+		{Deblock: &Deblock{}},
+		{Quantize: &Quantize{Dither: DitherOrdered, OnePass: true}},
+	} {
+		if _, err := DecodeBytes(file, &opt); !errors.Is(err, ErrNoCgo) {
+			t.Fatalf("%+v: expected ErrNoCgo, got %v", opt, err)
+		}
+	}
+	if f := Capabilities(); f.Library != "image/jpeg" || f.Arithmetic {
+		t.Fatalf("%+v", f)
+	}
+}
+
+func TestTranscodeNoCgo(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(img)
+	for _, q := range []int{50, 95} {
+		var buf, out bytes.Buffer
+		if err := Encode(&buf, img, &Options{Quality: q}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := Transcode(&out, bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		want := ActionPassThrough
+		if q == 95 {
+			want = ActionReencode
+		}
+		if res.Action != want || res.Out != out.Len() {
+			t.Fatalf("quality %d: %+v", q, res)
+		}
+	}
+}
+
+func TestQuantizeNoCgo(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(img)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []Quantize{
+		{Colors: 16},
+		{Colors: 27, OnePass: true, Dither: DitherNone},
+		{Palette: color.Palette{color.Black, color.White}},
+	} {
+		got, err := DecodeBytes(buf.Bytes(), &DecoderOptions{Quantize: &q, ScaleTo: image.Pt(32, 24)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := got.(*image.Paletted)
+		n := q.Colors
+		if q.Palette != nil {
+			n = len(q.Palette)
+		}
+		if p.Rect.Dx() != 32 || len(p.Palette) == 0 || len(p.Palette) > n {
+			t.Fatalf("%+v: %v of %d colors", q, p.Rect, len(p.Palette))
+		}
+	}
+	if _, err := DecodeBytes(buf.Bytes(), &DecoderOptions{Quantize: &Quantize{Colors: 4}}); err == nil {
+		t.Fatal("quantized to 4 colors")
+	}
+}
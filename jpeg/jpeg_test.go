@@ -2,10 +2,22 @@ package jpeg
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ezdiy/image/exif"
+	"github.com/ezdiy/image/mpf"
+	"github.com/ezdiy/image/util"
+	"github.com/ezdiy/image/xmp"
 	"image"
 	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
 	"runtime"
 	"testing"
+	"testing/iotest"
 )
 
 func one(t *testing.T) {
@@ -35,3 +47,984 @@ func TestEncodeDecode(t *testing.T) {
 	runtime.GC()
 	runtime.GC()
 }
+
+// Fill image with a gradient, red along x and green along y.
+func gradient(img draw.Image) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			img.Set(x, y, color.NRGBA{byte(x * 4), byte(y * 4), 128, 255})
+		}
+	}
+}
+
+func near(a, b uint32, fuzz uint32) bool {
+	a, b = a>>8, b>>8
+	if a > b {
+		a, b = b, a
+	}
+	return b-a <= fuzz
+}
+
+func checkSimilar(t *testing.T, name string, want, got image.Image, fuzz uint32) {
+	if want.Bounds().Size() != got.Bounds().Size() {
+		t.Fatalf("%s: size %v != %v", name, got.Bounds().Size(), want.Bounds().Size())
+	}
+	wb, gb := want.Bounds(), got.Bounds()
+	for y := 0; y < wb.Dy(); y += 7 {
+		for x := 0; x < wb.Dx(); x += 7 {
+			r1, g1, b1, _ := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			r2, g2, b2, _ := got.At(gb.Min.X+x, gb.Min.Y+y).RGBA()
+			if !near(r1, r2, fuzz) || !near(g1, g2, fuzz) || !near(b1, b2, fuzz) {
+				t.Fatalf("%s: pixel %d,%d differs: %d,%d,%d != %d,%d,%d", name, x, y,
+					r2>>8, g2>>8, b2>>8, r1>>8, g1>>8, b1>>8)
+			}
+		}
+	}
+}
+
+// Custom image type, to exercise the generic path.
+type customImage struct{ *image.NRGBA }
+
+func TestEncodeModels(t *testing.T) {
+	r := image.Rect(0, 0, 64, 48)
+	pal := color.Palette{}
+	for i := 0; i < 256; i++ {
+		pal = append(pal, color.RGBA{byte(i), byte(255 - i), 128, 255})
+	}
+	// Valid, if unreachable by pixels.
+	for len(pal) < 300 {
+		pal = append(pal, pal[0])
+	}
+	ims := map[string]draw.Image{
+		"RGBA":    image.NewRGBA(r),
+		"RGBA64":  image.NewRGBA64(r),
+		"NRGBA":   image.NewNRGBA(r),
+		"NRGBA64": image.NewNRGBA64(r),
+		"Gray":    image.NewGray(r),
+		"Gray16":  image.NewGray16(r),
+		"CMYK":    image.NewCMYK(r),
+		"Alpha":   image.NewAlpha(r),
+		"Alpha16": image.NewAlpha16(r),
+		"Palette": image.NewPaletted(r, pal),
+		"Custom":  customImage{image.NewNRGBA(r)},
+	}
+	for name, img := range ims {
+		gradient(img)
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Quality: 100}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		out, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if name == "CMYK" {
+			continue // Not comparable, as the CMYK file is Adobe inverted.
+		}
+		checkSimilar(t, name, img, out, 16)
+	}
+	for _, ssr := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420} {
+		yuv := image.NewNYCbCrA(r, ssr)
+		for i := range yuv.Y {
+			yuv.Y[i] = byte(i)
+		}
+		for i := range yuv.A {
+			yuv.A[i] = 255
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, yuv, &Options{Quality: 100}); err != nil {
+			t.Fatal(err)
+		}
+		out, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSimilar(t, "NYCbCrA", yuv, out, 16)
+	}
+}
+
+func TestEncodeTransparent(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = 255, 0, 0, 128
+	}
+	yuv := image.NewNYCbCrA(img.Rect, image.YCbCrSubsampleRatio444)
+	for i := range yuv.Y {
+		yuv.Y[i], yuv.Cb[i], yuv.Cr[i] = color.RGBToYCbCr(255, 0, 0)
+		yuv.A[i] = 128
+	}
+	for _, tc := range []struct {
+		img     image.Image
+		opt     Options
+		r, g, b uint32
+	}{
+		{img, Options{}, 255, 127, 127},
+		{img, Options{Background: color.Black}, 128, 0, 0},
+		{img, Options{Background: color.RGBA{0, 0, 255, 255}}, 128, 0, 127},
+		{img, Options{Alpha: AlphaIgnore}, 255, 0, 0},
+		{yuv, Options{}, 255, 127, 127},
+		{yuv, Options{Alpha: AlphaIgnore}, 255, 0, 0},
+	} {
+		tc.opt.Quality = 100
+		var buf bytes.Buffer
+		if err := Encode(&buf, tc.img, &tc.opt); err != nil {
+			t.Fatal(err)
+		}
+		out, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, g, b, _ := out.At(8, 8).RGBA()
+		if !near(r, tc.r<<8, 3) || !near(g, tc.g<<8, 3) || !near(b, tc.b<<8, 3) {
+			t.Fatalf("%T %+v: got %d,%d,%d, want %d,%d,%d", tc.img, tc.opt, r>>8, g>>8, b>>8, tc.r, tc.g, tc.b)
+		}
+	}
+	if err := Encode(ioutil.Discard, img, &Options{Alpha: AlphaError}); err != ErrTransparent {
+		t.Fatalf("expected ErrTransparent, got %v", err)
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i+3] = 255
+	}
+	if err := Encode(ioutil.Discard, img, &Options{Alpha: AlphaError}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	r := image.Rect(0, 0, 67, 53)
+	sub := image.Rect(3, 5, 40, 33)
+	ims := map[string]image.Image{
+		"RGBA":  image.NewRGBA(r),
+		"NRGBA": image.NewNRGBA(r),
+		"Gray":  image.NewGray(r),
+		"CMYK":  image.NewCMYK(r),
+	}
+	for _, ssr := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio440} {
+		yuv := image.NewYCbCr(r, ssr)
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				yuv.Y[yuv.YOffset(x, y)] = byte(x * 4)
+				c := yuv.COffset(x, y)
+				yuv.Cb[c], yuv.Cr[c] = byte(y*4), 128
+			}
+		}
+		ims[ssr.String()] = yuv
+	}
+	for name, img := range ims {
+		if d, ok := img.(draw.Image); ok {
+			gradient(d)
+		}
+		for _, rect := range []image.Rectangle{sub, sub.Add(image.Pt(1, 1)), image.Rect(50, 40, 67, 53)} {
+			si := util.Crop(img, &rect)
+			var buf bytes.Buffer
+			if err := Encode(&buf, si, &Options{Quality: 100}); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			out, err := Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if name == "CMYK" {
+				continue
+			}
+			checkSimilar(t, name, si, out, 16)
+		}
+	}
+}
+
+// Chroma of sub-images which start mid-sample must stay with its luma. Box resampling
+// errs by (n-1)/n of the step at most, right at the edge, shifted chroma by all of it.
+func TestEncodeSubImageChroma(t *testing.T) {
+	for _, ssr := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410} {
+		yuv := image.NewYCbCr(image.Rect(0, 0, 64, 48), ssr)
+		for i := range yuv.Y {
+			yuv.Y[i] = 128
+		}
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				c := yuv.COffset(x, y)
+				yuv.Cb[c], yuv.Cr[c] = 0, 0
+				if x >= 16 {
+					yuv.Cb[c] = 255
+				}
+				if y >= 16 {
+					yuv.Cr[c] = 255
+				}
+			}
+		}
+		v, h := util.SSR2VHDiv(ssr)
+		if v > h {
+			h = v
+		}
+		fuzz := 255 - 255/h + 8
+		for _, off := range []image.Point{{1, 1}, {3, 2}, {2, 3}} {
+			rect := image.Rect(off.X, off.Y, 48, 40)
+			si := util.Crop(yuv, &rect).(*image.YCbCr)
+			var buf bytes.Buffer
+			if err := Encode(&buf, si, &Options{Quality: 100}); err != nil {
+				t.Fatal(ssr, off, err)
+			}
+			out, err := DecodeBytes(buf.Bytes(), &DecoderOptions{NoFancyUpsampling: true})
+			if err != nil {
+				t.Fatal(ssr, off, err)
+			}
+			for y := 0; y < rect.Dy(); y++ {
+				for x := 0; x < rect.Dx(); x++ {
+					w := si.YCbCrAt(rect.Min.X+x, rect.Min.Y+y)
+					g := color.YCbCrModel.Convert(out.At(x, y)).(color.YCbCr)
+					if d := int(w.Cb) - int(g.Cb); d < -fuzz || d > fuzz {
+						t.Fatalf("%v at %v: Cb of pixel %d,%d is %d, want %d", ssr, off, x, y, g.Cb, w.Cb)
+					}
+					if d := int(w.Cr) - int(g.Cr); d < -fuzz || d > fuzz {
+						t.Fatalf("%v at %v: Cr of pixel %d,%d is %d, want %d", ssr, off, x, y, g.Cr, w.Cr)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeSubsampling(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	gradient(img)
+	for _, ssr := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411,
+		image.YCbCrSubsampleRatio410} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Subsampling: ssr, UseSubsampling: true}); err != nil {
+			t.Fatal(err)
+		}
+		out, err := DecodeImage(&buf, &DecoderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 4:1:0 has too many blocks in MCU for raw decoding, and comes out as RGB.
+		yuv, ok := out.(*image.YCbCr)
+		if (!ok && ssr != image.YCbCrSubsampleRatio410) || (ok && yuv.SubsampleRatio != ssr) {
+			t.Fatalf("%v: got %T", ssr, out)
+		}
+	}
+	if err := Encode(ioutil.Discard, img, &Options{Subsampling: 42, UseSubsampling: true}); err == nil {
+		t.Fatal("expected error for invalid ratio")
+	}
+	// Zero ratio is 4:4:4, ignored unless asked for.
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Subsampling: image.YCbCrSubsampleRatio444}); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := DecodeImage(&buf, nil); err != nil {
+		t.Fatal(err)
+	} else if yuv, ok := out.(*image.YCbCr); !ok || yuv.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		t.Fatalf("default: got %T", out)
+	}
+}
+
+func TestEncodeGrayFuzz(t *testing.T) {
+	noisy := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := 0; i < len(noisy.Pix); i += 4 {
+		v := byte(i / 4 % 250)
+		noisy.Pix[i], noisy.Pix[i+1], noisy.Pix[i+2], noisy.Pix[i+3] = v, v+2, v+1, 255
+	}
+	colorful := image.NewRGBA(noisy.Rect)
+	gradient(colorful)
+	yuv := image.NewYCbCr(noisy.Rect, image.YCbCrSubsampleRatio420)
+	for i := range yuv.Cb {
+		yuv.Cb[i], yuv.Cr[i] = 128, 128
+	}
+	exact := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for i := 0; i < len(exact.Pix); i += 4 {
+		v := byte(i / 4 % 251)
+		exact.Pix[i], exact.Pix[i+1], exact.Pix[i+2], exact.Pix[i+3] = v, v, v, 255
+	}
+	// A single red pixel off any sampling grid.
+	stamped := image.NewRGBA(exact.Rect)
+	copy(stamped.Pix, exact.Pix)
+	stamped.SetRGBA(333, 217, color.RGBA{255, 0, 0, 255})
+	for _, tc := range []struct {
+		img  image.Image
+		fuzz int
+		gray bool
+	}{
+		{noisy, 0, false},
+		{noisy, 1, false},
+		{noisy, 4, true},
+		{colorful, 4, false},
+		{colorful, GrayFuzzAlways, true},
+		{yuv, 1, true},
+		{noisy, GrayFuzzExact, false},
+		{exact, GrayFuzzExact, true},
+		{stamped, 4, false},
+		{util.Crop(stamped, &image.Rectangle{image.Pt(334, 0), image.Pt(640, 480)}), GrayFuzzExact, true},
+	} {
+		var buf bytes.Buffer
+		var gray bool
+		if err := Encode(&buf, tc.img, &Options{GrayFuzz: tc.fuzz, Grayscale: &gray}); err != nil {
+			t.Fatal(err)
+		}
+		if gray != tc.gray {
+			t.Fatalf("%T fuzz %d: gray %v", tc.img, tc.fuzz, gray)
+		}
+		out, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := out.(*image.Gray); ok != tc.gray {
+			t.Fatalf("%T fuzz %d: decoded %T", tc.img, tc.fuzz, out)
+		}
+	}
+}
+
+// Empty palette is no palette, so one gets picked.
+func TestQuantizeEmptyPalette(t *testing.T) {
+	for _, img := range []draw.Image{image.NewNRGBA(image.Rect(0, 0, 64, 48)), image.NewGray(image.Rect(0, 0, 64, 48))} {
+		gradient(img)
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		q := Quantize{Colors: 16, Palette: color.Palette{}}
+		got, err := DecodeBytes(buf.Bytes(), &DecoderOptions{Quantize: &q})
+		if err != nil {
+			t.Fatalf("%T: %v", img, err)
+		}
+		if p := got.(*image.Paletted); len(p.Palette) == 0 || len(p.Palette) > 16 {
+			t.Fatalf("%T: palette of %d colors", img, len(p.Palette))
+		}
+	}
+}
+
+// Zero sampling factors are nonsense, and must not get divided by.
+func TestBadSampling(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	gradient(img)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Quality: 95, NoProgressive: true}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := Inspect(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	for _, m := range info.Markers {
+		if m.Code == info.SOF {
+			file[m.Offset+4+6+3+1] = 0 // Sampling of second component
+		}
+	}
+	if _, err := Inspect(bytes.NewReader(file)); err == nil {
+		t.Fatal("zero sampling factors accepted")
+	}
+	if _, err := Transcode(ioutil.Discard, bytes.NewReader(file), nil); err == nil {
+		t.Fatal("transcoded zero sampling factors")
+	}
+	if _, err := DecodeConfig(bytes.NewReader(file)); err == nil {
+		t.Fatal("zero sampling factors accepted by DecodeConfig")
+	}
+}
+
+func TestDensity(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for _, d := range []Density{{}, {DensityInch, 300, 300}, {DensityCm, 118, 59}, {DensityNone, 2, 1}} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Density: d}); err != nil {
+			t.Fatal(err)
+		}
+		var got Density
+		var cfg image.Config
+		if _, err := DecodeImage(bytes.NewReader(buf.Bytes()), &DecoderOptions{Density: &got, Config: &cfg}); err != nil {
+			t.Fatal(err)
+		}
+		want := d
+		if d.X == 0 {
+			want = Density{DensityNone, 1, 1}
+		}
+		if got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+		got = Density{}
+		if _, err := DecodeImage(&buf, &DecoderOptions{Density: &got}); err != nil || got != want {
+			t.Fatalf("got %+v, want %+v (%v)", got, want, err)
+		}
+	}
+	if x, y := (Density{DensityCm, 100, 50}).DPI(); x != 254 || y != 127 {
+		t.Fatalf("DPI %v %v", x, y)
+	}
+	if err := Encode(ioutil.Discard, img, &Options{Density: Density{DensityInch, 1 << 16, 1}}); err == nil {
+		t.Fatal("expected error for out of range density")
+	}
+
+	// Only JFIF has density, files with Adobe marker instead can't.
+	rgb := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	cmyk := image.NewCMYK(rgb.Rect)
+	dpi := Density{DensityInch, 300, 300}
+	for _, c := range []struct {
+		img image.Image
+		cs  ColorSpace
+	}{
+		{rgb, ColorSpaceRGB},
+		{cmyk, ColorSpaceDefault},
+		{cmyk, ColorSpaceCMYK},
+		{cmyk, ColorSpaceYCCK},
+	} {
+		if err := Encode(ioutil.Discard, c.img, &Options{Density: dpi, JPEGColorSpace: c.cs}); err == nil {
+			t.Fatalf("%T as %v: density without JFIF accepted", c.img, c.cs)
+		}
+		if err := Encode(ioutil.Discard, c.img, &Options{JPEGColorSpace: c.cs}); err != nil {
+			t.Fatalf("%T as %v: %v", c.img, c.cs, err)
+		}
+	}
+	for _, cs := range []ColorSpace{ColorSpaceDefault, ColorSpaceYCbCr} {
+		if err := Encode(ioutil.Discard, rgb, &Options{Density: dpi, JPEGColorSpace: cs}); err != nil {
+			t.Fatalf("%v: %v", cs, err)
+		}
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	e := exif.New(binary.BigEndian)
+	if err := e.Set(exif.IFD0, exif.Tag{ID: exif.TagOrientation, Type: exif.Short, Value: []uint16{3}}); err != nil {
+		t.Fatal(err)
+	}
+	app1, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	markers := []Marker{{MarkerAPP1, app1}, {MarkerCOM, []byte("hello")}}
+	if err := Encode(&buf, img, &Options{Markers: markers}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("hello")) {
+		t.Fatal("comment not written")
+	}
+	e2, err := exif.ReadJPEG(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := e2.Get(exif.IFD0, exif.TagOrientation); !reflect.DeepEqual(o.Value, []uint16{3}) {
+		t.Fatalf("orientation %v", o.Value)
+	}
+	if err := Encode(ioutil.Discard, img, &Options{Markers: []Marker{{0xd8, nil}}}); err == nil {
+		t.Fatal("expected error for SOI marker")
+	}
+}
+
+func TestDecodeMarkers(t *testing.T) {
+	p := xmp.New()
+	if err := p.Set(xmp.NsXMP, "Rating", "4"); err != nil {
+		t.Fatal(err)
+	}
+	ext := xmp.New()
+	if err := ext.Set(xmp.NsDC, "description", string(bytes.Repeat([]byte("x"), 100000))); err != nil {
+		t.Fatal(err)
+	}
+	p.Extended = ext.XML
+	app1, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	markers := Markers{{MarkerCOM, []byte("hello")}}
+	for _, b := range app1 {
+		markers = append(markers, Marker{MarkerAPP1, b})
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), &Options{Markers: markers}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Markers
+	var cfg image.Config
+	if _, err := DecodeImage(bytes.NewReader(buf.Bytes()), &DecoderOptions{Config: &cfg, Markers: &got}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(markers)+1 || got[0].Code != MarkerAPP0 {
+		t.Fatalf("got %d markers", len(got))
+	}
+	if !reflect.DeepEqual(got[1:], markers) {
+		t.Fatal("markers differ")
+	}
+	p2, err := xmp.Decode(got.Payloads(MarkerAPP1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p2.Extended, p.Extended) {
+		t.Fatal("extended XMP differs")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 640, 400))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{200, 100, 50, 255}), image.ZP, draw.Src)
+	e := exif.New(binary.LittleEndian)
+	if err := e.Set(exif.IFD0, exif.Tag{ID: exif.TagOrientation, Type: exif.Short, Value: []uint16{6}}); err != nil {
+		t.Fatal(err)
+	}
+	app1, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	opt := &Options{Thumbnail: image.Pt(160, 120), Markers: Markers{{MarkerAPP1, app1}}}
+	if err := Encode(&buf, img, opt); err != nil {
+		t.Fatal(err)
+	}
+	if len(opt.Markers[0].Data) != len(app1) {
+		t.Fatal("options modified")
+	}
+	e2, err := exif.ReadJPEG(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := e2.Get(exif.IFD0, exif.TagOrientation); !reflect.DeepEqual(o.Value, []uint16{6}) {
+		t.Fatalf("orientation %v", o.Value)
+	}
+	thumb, err := exif.ReadThumbnail(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timg, err := Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSimilar(t, "thumbnail", img.SubImage(image.Rect(0, 0, 160, 100)), timg, 3)
+
+	// Scaled decoding of the main image.
+	simg, err := DecodeImage(bytes.NewReader(buf.Bytes()), &DecoderOptions{ScaleTo: image.Pt(160, 100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := simg.Bounds().Size(); s != image.Pt(160, 100) {
+		t.Fatalf("scaled to %v", s)
+	}
+	thumb, err = ThumbnailFrom(bytes.NewReader(buf.Bytes()), image.Pt(100, 100), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := DecodeConfig(bytes.NewReader(thumb)); err != nil || cfg.Width != 100 || cfg.Height != 63 {
+		t.Fatalf("thumbnail %dx%d %v", cfg.Width, cfg.Height, err)
+	}
+}
+
+func TestGainMap(t *testing.T) {
+	primary := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(primary)
+	gm := image.NewGray(image.Rect(0, 0, 16, 12))
+	for i := range gm.Pix {
+		gm.Pix[i] = byte(i)
+	}
+	meta := &GainMap{Max: 2.5, OffsetSDR: 1.0 / 64, OffsetHDR: 1.0 / 64, CapacityMax: 2.5}
+	p := xmp.New()
+	if err := p.Set(xmp.NsXMP, "Rating", "5"); err != nil {
+		t.Fatal(err)
+	}
+	app1, _ := p.Encode()
+	var buf bytes.Buffer
+	opt := &Options{Quality: 90, Markers: Markers{{MarkerAPP1, app1[0]}}}
+	if err := EncodeGainMap(&buf, primary, gm, meta, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain decoders see the primary image.
+	img, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSimilar(t, "primary", primary, img, 8)
+	imgs, ix, err := DecodePictures(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2 || ix.Entries[0].Type != mpf.Primary || imgs[1].Bounds() != gm.Bounds() {
+		t.Fatalf("%d pictures, %+v", len(imgs), ix)
+	}
+
+	img, gimg, meta2, err := DecodeGainMap(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Gamma = 1
+	if *meta2 != *meta {
+		t.Fatalf("meta %+v != %+v", meta2, meta)
+	}
+	checkSimilar(t, "primary", primary, img, 8)
+	checkSimilar(t, "gain map", gm, gimg, 4)
+	p2, err := xmp.ReadJPEG(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p2.Get(xmp.NsXMP, "Rating"); v != "5" {
+		t.Fatal("lost primary XMP")
+	}
+	if v, _ := p2.Get(NsGainMap, "Version"); v != "1.0" {
+		t.Fatal("no hdrgm:Version in primary")
+	}
+
+	// Plain JPEG has no gain map, but decodes as a single picture.
+	if _, _, _, err := DecodeGainMap(bytes.NewReader(buf.Bytes()[:0]), nil); err == nil {
+		t.Fatal("expected error")
+	}
+	buf.Reset()
+	Encode(&buf, primary, nil)
+	if _, _, _, err := DecodeGainMap(bytes.NewReader(buf.Bytes()), nil); err != ErrNoGainMap {
+		t.Fatalf("expected ErrNoGainMap, got %v", err)
+	}
+	if imgs, ix, err := DecodePictures(bytes.NewReader(buf.Bytes()), nil); err != nil || len(imgs) != 1 || ix != nil {
+		t.Fatal("single picture", err)
+	}
+}
+
+func TestEstimateQuality(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	gradient(img)
+	for _, q := range []int{10, 50, 75, 93, 100} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Quality: q}); err != nil {
+			t.Fatal(err)
+		}
+		est, err := EstimateQuality(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est.Luma != q || est.Chroma != q || est.Family != FamilyIJG || est.Custom {
+			t.Fatalf("quality %d estimated as %+v", q, est)
+		}
+	}
+
+	// Custom tables roughly of quality 90.
+	var tables [2][64]byte
+	for i := range tables[0] {
+		tables[0][i] = byte(3 + i/4)
+		tables[1][i] = byte(5 + i/3)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Quality: 50, QuantTables: &tables}); err != nil {
+		t.Fatal(err)
+	}
+	var q QualityEstimate
+	var cfg image.Config
+	if _, err := DecodeImage(&buf, &DecoderOptions{Config: &cfg, Quality: &q}); err != nil {
+		t.Fatal(err)
+	}
+	if !q.Custom || q.Family != FamilyCustom || q.Luma < 80 || q.Luma > 95 || q.Chroma < 75 || q.Chroma > 95 {
+		t.Fatalf("custom tables estimated as %+v", q)
+	}
+
+	// Family of alternative base tables, as mozjpeg would have.
+	bases := append([][2][64]uint16{baseQuantTables()[0]}, [2][64]uint16{})
+	for i := range bases[1][0] {
+		bases[1][0][i], bases[1][1][i] = 16, uint16(20+i)
+	}
+	luma, chroma := scaleTable(&bases[1][0], 80, 255), scaleTable(&bases[1][1], 80, 255)
+	if est := estimateQuality(&luma, &chroma, bases, false); est.Family != FamilyMozjpeg || est.BaseTable != 1 || est.Custom {
+		t.Fatalf("mozjpeg tables estimated as %+v", est)
+	}
+	if est := estimateQuality(&luma, &chroma, bases[:1], true); est.Family != FamilyPhotoshop || !est.Custom {
+		t.Fatalf("unknown tables with Adobe marker estimated as %+v", est)
+	}
+	// Annex K ones are assumed without base tables.
+	luma, chroma = scaleTable(&stdQuant[0], 80, 255), scaleTable(&stdQuant[1], 80, 255)
+	if est := estimateQuality(&luma, &chroma, nil, false); est.Family != FamilyIJG || est.Luma != 80 || est.Custom {
+		t.Fatalf("IJG tables without bases estimated as %+v", est)
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	buf.Reset()
+	if err := Encode(&buf, gray, &Options{Quality: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if est, _ := EstimateQuality(&buf); est.Luma != 60 || est.Chroma != 0 {
+		t.Fatalf("gray estimated as %+v", est)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	e := exif.New(binary.BigEndian)
+	for _, tag := range []exif.Tag{
+		{ID: exif.TagOrientation, Type: exif.Short, Value: []uint16{8}},
+		{ID: exif.TagMake, Type: exif.ASCII, Value: "Camera"},
+	} {
+		if err := e.Set(exif.IFD0, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app1, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := xmp.New()
+	if err := p.Set(xmp.NsXMP, "Rating", "2"); err != nil {
+		t.Fatal(err)
+	}
+	xmps, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	icc := append([]byte("ICC_PROFILE\x00\x01\x01"), make([]byte, 128)...)
+	markers := Markers{{MarkerAPP1, app1}, {MarkerAPP1, xmps[0]}, {MarkerAPP2, icc}, {MarkerCOM, []byte("comment")}}
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), &Options{Markers: markers}); err != nil {
+		t.Fatal(err)
+	}
+	in := append([]byte(nil), buf.Bytes()...)
+	dqt := bytes.Index(in, []byte{0xff, 0xdb})
+	in = append(in, "trailing"...)
+
+	buf.Reset()
+	if err := Strip(&buf, bytes.NewReader(in), &Keep{ICC: true, Orientation: true}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	if !bytes.HasSuffix(out, in[dqt:len(in)-8]) {
+		t.Fatal("image data changed, or trailing data kept")
+	}
+	var got Markers
+	if _, err := DecodeImage(bytes.NewReader(out), &DecoderOptions{Config: &image.Config{}, Markers: &got}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Code != MarkerAPP0 || got[2].Code != MarkerAPP2 || !bytes.Equal(got[2].Data, icc) {
+		t.Fatalf("kept %d markers", len(got))
+	}
+	e2, err := exif.Parse(got[1].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := e2.Get(exif.IFD0, exif.TagOrientation); !reflect.DeepEqual(o.Value, []uint16{8}) || len(e2.Dirs[exif.IFD0]) != 1 {
+		t.Fatalf("EXIF not reduced to orientation: %+v", e2.Dirs[exif.IFD0])
+	}
+
+	buf.Reset()
+	if err := Strip(&buf, bytes.NewReader(in), nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := Inspect(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range info.Markers[2:] {
+		if (m.Code >= MarkerAPP0 && m.Code <= MarkerAPP15) || m.Code == MarkerCOM {
+			t.Fatalf("marker 0x%02x left", m.Code)
+		}
+	}
+	if err := Strip(ioutil.Discard, bytes.NewReader(in[:dqt+10]), nil); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 60))
+	gradient(img)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	ref, err := Decode(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Into a part of a bigger frame.
+	frame := image.NewRGBA(image.Rect(0, 0, 120, 80))
+	dst := frame.SubImage(image.Rect(10, 10, 110, 70)).(*image.RGBA)
+	if err := DecodeInto(dst, bytes.NewReader(file), nil); err != nil {
+		t.Fatal(err)
+	}
+	rgba, err := DecodeImage(bytes.NewReader(file), &DecoderOptions{OutputColorspaces: []color.Model{color.RGBAModel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSimilar(t, "rgba", rgba, dst, 0)
+	if frame.RGBAAt(5, 5) != (color.RGBA{}) || frame.RGBAAt(110, 70) != (color.RGBA{}) {
+		t.Fatal("wrote outside of destination")
+	}
+	gray := image.NewGray(image.Rect(0, 0, 50, 30))
+	if err := DecodeInto(gray, bytes.NewReader(file), &DecoderOptions{ScaleTo: image.Pt(50, 30)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeInto(gray, bytes.NewReader(file), nil); err == nil {
+		t.Fatal("size mismatch not detected")
+	}
+	deblock := &DecoderOptions{Deblock: &Deblock{}}
+	if err := DecodeInto(dst, bytes.NewReader(file), deblock); err != errDeblockInto {
+		t.Fatalf("Deblock: expected errDeblockInto, got %v", err)
+	}
+	if err := DecodeYCbCrInto(image.NewYCbCr(image.Rect(0, 0, 112, 64), image.YCbCrSubsampleRatio420), bytes.NewReader(file), deblock); err != errDeblockInto {
+		t.Fatalf("Deblock: expected errDeblockInto, got %v", err)
+	}
+	if err := DecodeInto(image.NewCMYK(img.Rect), bytes.NewReader(file), nil); err == nil {
+		t.Fatal("YCbCr decoded into CMYK")
+	}
+
+	// Planes with strides of our own, reused.
+	ycc := image.NewYCbCr(image.Rect(0, 0, 112, 64), image.YCbCrSubsampleRatio420)
+	ycc.Rect = img.Rect
+	for i := 0; i < 2; i++ {
+		if err := DecodeYCbCrInto(ycc, bytes.NewReader(file), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := ref.(*image.YCbCr)
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 100; x++ {
+			if want.YCbCrAt(x, y) != ycc.YCbCrAt(x, y) {
+				t.Fatalf("pixel %d,%d differs", x, y)
+			}
+		}
+	}
+	short := image.NewYCbCr(img.Rect, image.YCbCrSubsampleRatio420)
+	if err := DecodeYCbCrInto(short, bytes.NewReader(file), nil); err == nil {
+		t.Fatal("short planes not detected")
+	}
+	ycc.SubsampleRatio = image.YCbCrSubsampleRatio444
+	if err := DecodeYCbCrInto(ycc, bytes.NewReader(file), nil); err == nil {
+		t.Fatal("subsampling mismatch not detected")
+	}
+}
+
+func TestStream(t *testing.T) {
+	var stream bytes.Buffer
+	var sizes []int
+	for i, size := range []image.Point{{40, 30}, {16, 16}, {80, 8}} {
+		img := image.NewNRGBA(image.Rectangle{Max: size})
+		gradient(img)
+		n := stream.Len()
+		if err := Encode(&stream, img, nil); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, stream.Len()-n)
+		if i == 0 {
+			stream.WriteString("\r\n--boundary\r\n\r\n")
+		}
+	}
+	for _, r := range []io.Reader{bytes.NewReader(stream.Bytes()), iotest.HalfReader(bytes.NewReader(stream.Bytes()))} {
+		s := NewStream(r)
+		for i, want := range []image.Point{{40, 30}, {16, 16}, {80, 8}} {
+			var nb int
+			img, err := s.Decode(&DecoderOptions{NBRead: &nb})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Size() != want || nb != sizes[i] {
+				t.Fatalf("image %d of %v, %d bytes read", i, img.Bounds().Size(), nb)
+			}
+		}
+		if _, err := s.Decode(nil); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	}
+
+	// Read errors come back as errors.
+	if _, err := Decode(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if _, err := Decode(iotest.TimeoutReader(iotest.OneByteReader(bytes.NewReader(stream.Bytes())))); err != iotest.ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestExtOptions(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	on, loops, table := true, 2, 3
+	opt := &Options{Ext: ExtOptions{Profile: ProfileFastest, Trellis: &on, TrellisLoops: &loops, BaseQuantTable: &table}}
+	if err := Encode(ioutil.Discard, img, opt); (err == nil) != Capabilities().CParams {
+		t.Fatalf("mozjpeg %v, got %v", Capabilities().CParams, err)
+	}
+	nan, mode, split := math.NaN(), 3, 64
+	for _, ext := range []ExtOptions{
+		{Profile: 1},
+		{LambdaLogScale1: &nan},
+		{DCScanMode: &mode},
+		{TrellisFreqSplit: &split},
+		{BaseQuantTable: &split},
+	} {
+		if err := Encode(ioutil.Discard, img, &Options{Ext: ext}); err == nil {
+			t.Fatalf("invalid %+v accepted", ext)
+		}
+	}
+}
+
+func TestJPEGColorSpace(t *testing.T) {
+	rgb := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	gradient(rgb)
+	cmyk := image.NewCMYK(rgb.Rect)
+	for i := range cmyk.Pix {
+		cmyk.Pix[i] = byte(i / 3)
+	}
+	ycc := image.NewYCbCr(rgb.Rect, image.YCbCrSubsampleRatio444)
+	for i := range ycc.Y {
+		ycc.Y[i], ycc.Cb[i], ycc.Cr[i] = byte(i), 100, 150
+	}
+	for _, tc := range []struct {
+		img   image.Image
+		cs    ColorSpace
+		model color.Model
+		ids   string
+		adobe int // Transform, -1 if no Adobe marker
+		fuzz  uint32
+	}{
+		{rgb, ColorSpaceDefault, color.YCbCrModel, "\x01\x02\x03", -1, 8},
+		{rgb, ColorSpaceRGB, color.NRGBAModel, "RGB", 0, 1},
+		{ycc, ColorSpaceRGB, color.NRGBAModel, "RGB", 0, 1},
+		{rgb, ColorSpaceGray, color.GrayModel, "\x01", -1, 2},
+		{ycc, ColorSpaceYCbCr, color.YCbCrModel, "\x01\x02\x03", -1, 2},
+		{cmyk, ColorSpaceDefault, color.CMYKModel, "CMYK", 0, 2},
+		{cmyk, ColorSpaceYCCK, color.CMYKModel, "\x01\x02\x03\x04", 2, 8},
+	} {
+		name := fmt.Sprintf("%T as %v", tc.img, tc.cs)
+		var buf bytes.Buffer
+		if err := Encode(&buf, tc.img, &Options{Quality: 100, JPEGColorSpace: tc.cs}); err != nil {
+			t.Fatal(name, err)
+		}
+		info, err := Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		ids := ""
+		for _, c := range info.Components {
+			ids += string(c.ID)
+		}
+		adobe := -1
+		for _, m := range info.Markers {
+			if m.Code == MarkerAPP14 {
+				adobe = int(buf.Bytes()[m.Offset+m.Length-1])
+			}
+		}
+		if ids != tc.ids || adobe != tc.adobe {
+			t.Fatalf("%s: components %q, Adobe transform %d", name, ids, adobe)
+		}
+		var cfg image.Config
+		got, err := DecodeImage(bytes.NewReader(buf.Bytes()), &DecoderOptions{Config: &cfg})
+		if err == nil {
+			got, err = DecodeBytes(buf.Bytes(), nil)
+		}
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if cfg.ColorModel != tc.model {
+			t.Fatalf("%s: decoded as %v", name, cfg.ColorModel)
+		}
+		want := tc.img
+		if tc.cs == ColorSpaceGray {
+			want = util.ToModel(want, color.GrayModel)
+		}
+		checkSimilar(t, name, want, got, tc.fuzz)
+	}
+
+	for _, tc := range []struct {
+		img image.Image
+		cs  ColorSpace
+	}{
+		{image.NewGray(rgb.Rect), ColorSpaceRGB},
+		{rgb, ColorSpaceCMYK},
+		{cmyk, ColorSpaceYCbCr},
+		{rgb, 99},
+	} {
+		if err := Encode(ioutil.Discard, tc.img, &Options{JPEGColorSpace: tc.cs}); err == nil {
+			t.Fatalf("%T stored as %v", tc.img, tc.cs)
+		}
+	}
+}
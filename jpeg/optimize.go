@@ -0,0 +1,82 @@
+//+build cgo
+
+package jpeg
+
+/*
+#include <stdio.h>
+#include <jpeglib.h>
+*/
+import "C"
+import (
+	"bytes"
+	"io"
+	"unsafe"
+)
+
+// Losslessly rewrite JPEG stream, like jpegtran -optimize -progressive. DCT coefficients
+// are kept as they are, only entropy coding changes: optimized Huffman tables (unless
+// FastHufftab), progressive scans (unless NoProgressive; Ext.OptimizeScans searches for the
+// best ones with mozjpeg) or arithmetic coding. Options dealing with pixels or
+// quantization have no effect. Segments of the source are copied, unless StripMetadata,
+// and so is density, unless set. Markers are appended.
+func Optimize(w io.Writer, r io.Reader, opt *Options) (err error) {
+	if opt == nil {
+		opt = &DefaultEncoderOptions
+	}
+	d := getDecoder(r)
+	e := getEncoder(w)
+	defer errHandle(&err, cleanups{d, e})
+	d.DecoderOptions = &DefaultDecoderOptions
+	e.Options = opt
+
+	d.saveMarkers(!opt.StripMetadata)
+	if C.jpeg_read_header(&d.dInfo, 1) != 1 {
+		throw("not a JPG file")
+	}
+	coefs := C.jpeg_read_coefficients(&d.dInfo)
+
+	// Profile decides what defaults do.
+	e.setProfile(opt.Ext.Profile)
+	C.jpeg_copy_critical_parameters(&d.dInfo, &e.cInfo)
+	e.setCodingOptions(opt)
+	C.jpeg_write_coefficients(&e.cInfo, coefs)
+
+	// Copy segments, except the ones libjpeg writes on its own.
+	ci := &e.cInfo
+	for m := d.dInfo.marker_list; m != nil; m = m.next {
+		data := C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length))
+		if ci.write_JFIF_header != 0 && m.marker == MarkerAPP0 && bytes.HasPrefix(data, []byte("JFIF\x00")) {
+			continue
+		}
+		if ci.write_Adobe_marker != 0 && m.marker == MarkerAPP14 && bytes.HasPrefix(data, []byte("Adobe")) {
+			continue
+		}
+		C.jpeg_write_marker(&e.cInfo, C.int(m.marker), m.data, m.data_length)
+	}
+	e.writeMarkers()
+
+	C.jpeg_finish_compress(&e.cInfo)
+	C.jpeg_finish_decompress(&d.dInfo)
+	if opt.Grayscale != nil {
+		*opt.Grayscale = ci.jpeg_color_space == C.JCS_GRAYSCALE
+	}
+	e.cleanup(false)
+	d.cleanup(false)
+	return nil
+}
+
+// Apply options which make sense for coefficients, after jpeg_copy_critical_parameters.
+func (w *encoder) setCodingOptions(opt *Options) {
+	ci := &w.cInfo
+	w.setExt(&opt.Ext)
+	ci.optimize_coding = bool2c(!opt.FastHufftab && !opt.ArithmeticCoding) // No Huffman tables with arithmetic coding
+	ci.arith_code = bool2c(opt.ArithmeticCoding)
+	if opt.NoProgressive {
+		w.setBool(paramOptimizeScans, false)
+		ci.num_scans = 0
+		ci.scan_info = nil
+	} else {
+		C.jpeg_simple_progression(&w.cInfo)
+	}
+	w.setDensity(opt.Density)
+}
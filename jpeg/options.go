@@ -1,6 +1,8 @@
 package jpeg
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 )
@@ -17,56 +19,250 @@ type Options struct {
 	Gamma               float64 // Gamma correction for input
 	DCTMethod
 
-	// Extended settings via GUID table
+	// Chroma subsampling when RGB input gets stored as YCbCr, used if UseSubsampling
+	// is set, as zero is 4:4:4. Otherwise libjpeg default of 4:2:0 is used.
+	// image.YCbCr input is always stored with its own ratio.
+	Subsampling    image.YCbCrSubsampleRatio
+	UseSubsampling bool
+
+	// Color space stored in the file, zero being YCbCr for color input and CMYK for
+	// CMYK. True RGB has no color transform, which suits screenshots at quality 100,
+	// and YCCK compresses CMYK better. Input which can't be stored as asked, such as
+	// gray as RGB, is an error. RGB, CMYK and YCCK files have no JFIF header, so no
+	// Density.
+	JPEGColorSpace ColorSpace
+
+	// If not 0, opaque color input is checked with util.IsGray using this fuzz, and if
+	// gray enough, gets written as single component grayscale. GrayFuzzAlways converts
+	// always, GrayFuzzExact only input with equal components. Applies only with default
+	// JPEGColorSpace.
+	GrayFuzz int
+
+	// JPEG has no alpha channel. This decides what happens to images which have
+	// transparent pixels. Default is to flatten onto Background.
+	Alpha      AlphaPolicy
+	Background color.Color // Background for AlphaFlatten. White if nil.
+
+	// Extra segments to write, such as EXIF (see exif.Exif.Marshal), ICC or comments.
+	Markers Markers
+
+	// If not zero, a thumbnail fitting these dimensions (160x120 is usual) is made
+	// from the image and stored in EXIF. EXIF found in Markers is kept, or created.
+	Thumbnail image.Point
+
+	// mozjpeg settings.
 	Ext ExtOptions
 
 	// Obscure features if you know what you're doing.
 	QuantTables      *[2][64]byte // Will get linearly scaled by quality.
 	ArithmeticCoding bool         // Enable arithmetic coding. Poorly supported.
 
-	NBWritten *int // If not nil, stores number of bytes written
+	// Pixel density stored in JFIF header. If X or Y is 0, 1:1 aspect with no unit is written.
+	// Setting it for a file without JFIF header, see JPEGColorSpace, is an error.
+	Density Density
+
+	// For Optimize, drop APPn and COM segments of the source file, including ICC profile.
+	// Markers are written still.
+	StripMetadata bool
+
+	NBWritten *int  // If not nil, stores number of bytes written
+	Grayscale *bool // If not nil, stores whether the image got written as grayscale
+}
+
+// Raw JPEG segment, such as APPn or COM.
+type Marker struct {
+	Code byte   // Marker code, MarkerAPP0-15 or MarkerCOM
+	Data []byte // Payload, without the length field
+}
+
+type Markers []Marker
+
+// Special values of Options.GrayFuzz, as 0 disables the check.
+const (
+	GrayFuzzAlways = -1
+	GrayFuzzExact  = -2
+)
+
+// Fuzz to check color input with for writing it as gray, if asked to.
+func (o *Options) grayFuzz() (fuzz int, ok bool) {
+	switch {
+	case o.GrayFuzz == 0 || o.JPEGColorSpace != ColorSpaceDefault:
+		return 0, false
+	case o.GrayFuzz == GrayFuzzExact:
+		return 0, true
+	case o.GrayFuzz < 0:
+		return -1, true
+	}
+	return o.GrayFuzz, true
+}
+
+// Get payloads of all markers with the given code.
+func (ms Markers) Payloads(code byte) (res [][]byte) {
+	for _, m := range ms {
+		if m.Code == code {
+			res = append(res, m.Data)
+		}
+	}
+	return
+}
+
+const (
+	MarkerAPP0  = 0xe0
+	MarkerAPP1  = 0xe1 // EXIF, XMP
+	MarkerAPP2  = 0xe2 // ICC profile, MPF
+	MarkerAPP14 = 0xee // Adobe
+	MarkerAPP15 = 0xef
+	MarkerCOM   = 0xfe
+
+	// Maximum size of segment payload.
+	MaxMarkerLen = 0xffff - 2
+)
+
+// JFIF pixel density.
+type Density struct {
+	Unit DensityUnit
+	X, Y int
+}
+
+// Pixels per inch, 0 if unknown.
+func (d Density) DPI() (x, y float64) {
+	switch d.Unit {
+	case DensityInch:
+		return float64(d.X), float64(d.Y)
+	case DensityCm:
+		return float64(d.X) * 2.54, float64(d.Y) * 2.54
+	}
+	return
+}
+
+type DensityUnit int
+
+const (
+	DensityNone DensityUnit = iota // X and Y specify only pixel aspect ratio
+	DensityInch                    // Dots per inch
+	DensityCm                      // Dots per centimeter
+)
+
+// Color quantization while decoding, see DecoderOptions.Quantize.
+type Quantize struct {
+	Colors  int           // Palette size, 0 means 256. Two pass quantization needs 8 at least.
+	Dither  DitherMode    // Ordered dithering needs OnePass, Floyd-Steinberg is used otherwise
+	OnePass bool          // Faster, but uses a uniform palette of lower quality
+	Palette color.Palette // Map to this palette instead of one chosen by libjpeg, if not empty. Not for CMYK.
+}
+
+type DitherMode int
+
+const (
+	DitherFS      DitherMode = iota // Floyd-Steinberg error diffusion
+	DitherOrdered                   // Ordered dithering, free of diffusion artifacts
+	DitherNone                      // Nearest color
+)
+
+// Deblocking decode, see DecoderOptions.Deblock.
+type Deblock struct {
+	Iterations int     // Smoothing passes, 0 means 20. Each costs about as much as a plain decode.
+	Strength   float64 // Step size of the first pass, in pixel values. 0 means 1.
+}
+
+// Color space of JPEG file, see Options.JPEGColorSpace.
+type ColorSpace int
+
+const (
+	ColorSpaceDefault ColorSpace = iota
+	ColorSpaceYCbCr              // Color transformed, chroma can be subsampled. With JFIF header.
+	ColorSpaceRGB                // No color transform, flagged by Adobe marker
+	ColorSpaceGray               // Luma only
+	ColorSpaceCMYK               // Plain CMYK, flagged by Adobe marker
+	ColorSpaceYCCK               // CMYK with color transform and subsampled chroma
+)
+
+var colorSpaceNames = []string{"default", "YCbCr", "RGB", "gray", "CMYK", "YCCK"}
+
+func (cs ColorSpace) String() string {
+	if cs < 0 || int(cs) >= len(colorSpaceNames) {
+		return fmt.Sprintf("ColorSpace(%d)", int(cs))
+	}
+	return colorSpaceNames[cs]
+}
+
+// Whether input of ColorSpaceGray, ColorSpaceRGB or ColorSpaceCMYK model can be
+// stored as cs.
+func (cs ColorSpace) storableFrom(in ColorSpace) bool {
+	switch cs {
+	case ColorSpaceDefault:
+		return true
+	case ColorSpaceGray:
+		return in != ColorSpaceCMYK
+	case ColorSpaceYCbCr, ColorSpaceRGB:
+		return in == ColorSpaceRGB
+	case ColorSpaceCMYK, ColorSpaceYCCK:
+		return in == ColorSpaceCMYK
+	}
+	return false
 }
 
-type ExtOptions map[uint64]interface{}
 type DCTMethod int
+type AlphaPolicy int
 
 const (
 	// For DCTMethod
 	DCTISlow DCTMethod = iota
 	DCTIFast
 	DCTFloat
+)
 
-	// GUIDs set as a key for Options.Ext[] map.
-	// There's 4 bits in front doing a ghetto runtime type check.
-	//
-	// Boolean
-	OptScans           = 0x0680C061E // optimize progressive coding scan
-	OptTrellis         = 0x0C5122033 // use trellis quantization
-	OptTrellisDC       = 0x0339D4C0C // use trellis quant for DC coefficient
-	OptEOB             = 0x0D7F73780 // optimize for sequences of EOB
-	OptLambdaWeight    = 0x0339DB65F // use lambda weighting table
-	OptTrellisUseScans = 0x0FD841435 // use scans in trellis optimization
-	OptTrellisQ        = 0x0E12AE269 // optimize quant table in trellis loop
-	OptDeringing       = 0x03F4BBBF9 // preprocess input to reduce ringing of edges on white background
-	//
-	// Float
-	OptLambdaLogScale1      = 0x15B61A599
-	OptLambdaLogScale2      = 0x1B9BBAE03
-	OPtTrellisDeltaDCWeight = 0x113775453
-	//
-	// Integer
-	OptCompressProfile   = 0x2E9918625 // compression profile
-	OptTrellisFreqSplit  = 0x26FAFF127 // splitting point for frequency in trellis quantization
-	OptTrellisLoops      = 0x2B63EBF39 // number of trellis loops
-	OptBaseQuantTblIndex = 0x244492AB1 // base quantization table index
-	OptDCScanMode        = 0x20BE7AD3C // DC scan optimization mode
-
-	// Profiles for OptCompressProfile
-	ProfileMaxCompression = 0x5D083AAD
-	ProfileFastest        = 0x2AEA5CB4
+// mozjpeg extensions, set via jpeg_c_set_*_param. Fields left nil keep the defaults
+// of Profile. Values are checked, and setting any of them with a library which
+// lacks the extensions is an error.
+type ExtOptions struct {
+	Profile CompressProfile
+
+	OptimizeScans   *bool // Optimize progressive coding scans
+	Trellis         *bool // Trellis quantization
+	TrellisDC       *bool // Trellis quantization of DC coefficients
+	OptimizeEOB     *bool // Optimize for sequences of EOB
+	LambdaWeight    *bool // Use lambda weighting table
+	TrellisUseScans *bool // Use scans in trellis optimization
+	TrellisQuant    *bool // Optimize quantization tables in trellis loop
+	Deringing       *bool // Preprocess input to reduce ringing of edges on white background
+
+	LambdaLogScale1      *float64
+	LambdaLogScale2      *float64
+	TrellisDeltaDCWeight *float64
+
+	TrellisFreqSplit *int // Frequency splitting point of trellis quantization, 0-63
+	TrellisLoops     *int // Number of trellis loops, 1 at least
+	BaseQuantTable   *int // Base quantization tables 0-8, see QualityEstimate.BaseTable
+	DCScanMode       *int // DC scan optimization mode 0-2
+}
+
+// mozjpeg compression profile, deciding defaults of other settings.
+type CompressProfile uint32
+
+const (
+	ProfileDefault        CompressProfile = 0          // Whatever the library defaults to
+	ProfileMaxCompression CompressProfile = 0x5D083AAD // mozjpeg default, progressive with trellis
+	ProfileFastest        CompressProfile = 0x2AEA5CB4 // libjpeg-turbo compatible
+)
+
+// For AlphaPolicy
+const (
+	AlphaFlatten AlphaPolicy = iota // Composite onto Options.Background.
+	AlphaError                      // Refuse to encode, return ErrTransparent.
+	AlphaIgnore                     // Drop the alpha channel, keeping color as-is.
 )
 
 var (
+	// Returned by Encode for transparent images with AlphaError policy.
+	ErrTransparent = errors.New("jpeg: image has transparent pixels")
+
+	// Wrapped by errors of options and features which need libjpeg, when built
+	// without cgo.
+	ErrNoCgo = errors.New("jpeg: unsupported without cgo")
+
+	// Returned by DecodeInto and DecodeYCbCrInto for options with Deblock.
+	errDeblockInto = errors.New("jpeg: can't deblock decoding into destination")
 
 	// WhitelistedSubsampling decoder option default.
 	// The library supports all ratios image.YCbCr knows about,
@@ -131,10 +327,37 @@ type DecoderOptions struct {
 	NoFancyUpsampling bool
 	NoBlockSmoothing  bool
 
+	// Decode scaled down by 1/2, 1/4 or 1/8, as far as the result still covers ScaleTo.
+	// DCT scaling is much faster than full decode followed by resize. Zero is full size.
+	ScaleTo image.Point
+
 	// If this pointer is set, will be filled by image information about color space
 	// and dimensions. No actual decoding will be done.
 	*image.Config
 
+	// If not nil, filled with JFIF pixel density. Zero if the file has no JFIF header.
+	// Works with Config too.
+	Density *Density
+
+	// If not nil, filled with APPn and COM segments of the file. Works with Config too.
+	Markers *Markers
+
+	// If not nil, filled with quality estimated from quantization tables. Works with
+	// Config too.
+	Quality *QualityEstimate
+
+	// If not nil, decode into image.Paletted of reduced colors, ignoring OutputColorspaces.
+	// Palette entries are color.RGBA, or color.Gray and color.CMYK for such files
+	// unless Quantize.Palette is given.
+	Quantize *Quantize
+
+	// If not nil, reconstruct the image from DCT coefficients, smoothing away blocking
+	// and ringing within the quantization interval of each coefficient, in the style of
+	// jpeg2png. Heavily compressed files look much better, at the cost of slow decoding.
+	// Applies to grayscale and YCbCr files image.YCbCr can represent, which decode as
+	// usual otherwise. Chroma isn't upsampled smoothly, and ScaleTo is ignored.
+	Deblock *Deblock
+
 	// If not nil, filled with number of bytes read from the input stream.
 	NBRead *int
 }
@@ -164,3 +387,17 @@ func (d *DecoderOptions) HasSSR(c image.YCbCrSubsampleRatio) (r bool) {
 	}
 	return
 }
+
+// What the linked JPEG library is and can do, see Capabilities.
+type Features struct {
+	Library    string // "libjpeg", "libjpeg-turbo" or "mozjpeg"
+	Version    string // Of libjpeg-turbo or mozjpeg as their headers tell, of libjpeg as it reports itself
+	APIVersion int    // JPEG_LIB_VERSION the package is built against: 62, 70, 80 or 90
+
+	CParams    bool // jpeg_c_set_*_param, which ExtOptions need
+	Arithmetic bool // Arithmetic coding, both ways
+	Bits12     bool // 12-bit samples, which this package doesn't decode still
+	Lossless   bool // Lossless JPEG
+	CropSkip   bool // jpeg_crop_scanline and jpeg_skip_scanlines
+	ICC        bool // jpeg_read_icc_profile and jpeg_write_icc_profile
+}
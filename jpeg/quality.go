@@ -0,0 +1,148 @@
+package jpeg
+
+import (
+	"image"
+	"io"
+	"math"
+)
+
+// Where quantization tables of a file likely come from.
+type TableFamily int
+
+const (
+	FamilyIJG       TableFamily = iota // libjpeg and friends, Annex K tables scaled by quality
+	FamilyMozjpeg                      // One of mozjpeg's ExtOptions.BaseQuantTable tables
+	FamilyPhotoshop                    // Tables of no known family, with Adobe marker
+	FamilyCustom                       // Tables of no known family, usually a camera
+)
+
+var familyNames = []string{"IJG", "mozjpeg", "Photoshop", "custom"}
+
+// Annex K quantization tables [luma, chroma] IJG ones are scaled from, in natural order.
+var stdQuant = [2][64]uint16{{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}, {
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}}
+
+func (f TableFamily) String() string {
+	if f < 0 || int(f) >= len(familyNames) {
+		return "unknown"
+	}
+	return familyNames[f]
+}
+
+// Quality of a file, estimated from its quantization tables.
+type QualityEstimate struct {
+	Luma, Chroma int // Closest IJG quality 1-100. Chroma is 0 for single component files.
+	Family       TableFamily
+	BaseTable    int  // ExtOptions.BaseQuantTable, for FamilyMozjpeg
+	Custom       bool // Tables don't match any known family at any quality
+}
+
+// Estimate quality of JPEG stream. Reads only the header.
+func EstimateQuality(r io.Reader) (q QualityEstimate, err error) {
+	var cfg image.Config
+	_, err = DecodeImage(r, &DecoderOptions{Config: &cfg, Quality: &q})
+	return
+}
+
+// Scale base table like jpeg_set_quality does. Values are clamped to max.
+func scaleTable(base *[64]uint16, quality int, max int) (res [64]uint16) {
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i, b := range base {
+		v := (int(b)*scale + 50) / 100
+		if v < 1 {
+			v = 1
+		} else if v > max {
+			v = max
+		}
+		res[i] = uint16(v)
+	}
+	return
+}
+
+// Find quality at which base scales exactly into table.
+func exactQuality(table, base *[64]uint16) (int, bool) {
+	for q := 1; q <= 100; q++ {
+		for _, max := range []int{255, 32767} {
+			if scaleTable(base, q, max) == *table {
+				return q, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Find quality which makes base closest to table.
+func closestQuality(table, base *[64]uint16) (quality int) {
+	if q, ok := exactQuality(table, base); ok {
+		return q
+	}
+	best := math.Inf(1)
+	for q := 1; q <= 100; q++ {
+		// Relative error, so that high frequencies don't dominate.
+		var e float64
+		for i, v := range scaleTable(base, q, 32767) {
+			e += math.Abs(math.Log(float64(table[i]) / float64(v)))
+		}
+		if e < best {
+			best, quality = e, q
+		}
+	}
+	return
+}
+
+// Estimate quality given luma and (optional) chroma table of a file, and the base
+// tables [luma, chroma] known to the library, IJG first.
+func estimateQuality(luma, chroma *[64]uint16, bases [][2][64]uint16, adobe bool) (q QualityEstimate) {
+	if len(bases) == 0 {
+		bases = [][2][64]uint16{stdQuant}
+	}
+	for i := range luma {
+		if luma[i] == 0 || (chroma != nil && chroma[i] == 0) {
+			return QualityEstimate{Family: FamilyCustom, Custom: true} // Broken, can't tell
+		}
+	}
+	q.Luma = closestQuality(luma, &bases[0][0])
+	if chroma != nil {
+		q.Chroma = closestQuality(chroma, &bases[0][1])
+	}
+	for i, base := range bases {
+		if _, ok := exactQuality(luma, &base[0]); !ok {
+			continue
+		}
+		if chroma != nil {
+			if _, ok := exactQuality(chroma, &base[1]); !ok {
+				continue
+			}
+		}
+		if i > 0 {
+			q.Family, q.BaseTable = FamilyMozjpeg, i
+		}
+		return
+	}
+	q.Custom = true
+	q.Family = FamilyCustom
+	if adobe {
+		q.Family = FamilyPhotoshop
+	}
+	return
+}
@@ -5,12 +5,14 @@ package jpeg
 /*
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
 #include <jpeglib.h>
 // Gray and YCbCr decode planes directly, advancing by subsample scaled stride for each.
-// buf will be laid out one component plane after another. Initial strides are of downsampled_width,
-// aligned to 32 byte due to SIMD. Buffer should also start at 32 aligne address as well.
-static int decodeRaw(j_decompress_ptr dinfo, unsigned char *buf, int *strides) {
+// Each plane must hold whole blocks, strides of downsampled_width aligned to DCTSIZE at
+// least. Newly allocated planes are aligned to 32 bytes due to SIMD.
+static int decodeRaw(j_decompress_ptr dinfo, unsigned char *p0, unsigned char *p1, unsigned char *p2, int *strides) {
 #define imcuRows(plane) (DCTSIZE * dinfo->comp_info[plane].v_samp_factor)
+	unsigned char *bufs[] = { p0, p1, p2 };
 	int numPlanes = dinfo->num_components;
 
 	// Construct the initial row vector for each plane.
@@ -19,12 +21,9 @@ static int decodeRaw(j_decompress_ptr dinfo, unsigned char *buf, int *strides) {
 		int stride = strides[i];
 		int pRows = imcuRows(i);
 		planes[i] = alloca(pRows * sizeof(void*));
-		for (int j = 0; j < pRows; j++) {
-			planes[i][j] = buf;
-			buf += stride;
-		}
-		// Skip over to next plane. -1 because loop above consumed one imcu.
-		buf += (strides[i] *= pRows) * (dinfo->total_iMCU_rows-1);
+		for (int j = 0; j < pRows; j++)
+			planes[i][j] = bufs[i] + j * stride;
+		strides[i] *= pRows;
 	}
 
 	int nImcu = 0;
@@ -58,14 +57,34 @@ static int decodeScan(j_decompress_ptr dinfo, unsigned char *buf, int stride) {
 	return nLines;
 }
 
+// Install colormap of n RGB triplets for quantization.
+static void setColormap(j_decompress_ptr dinfo, unsigned char *rgb, int n) {
+	JSAMPARRAY map = (*dinfo->mem->alloc_sarray)((j_common_ptr)dinfo, JPOOL_IMAGE, n, 3);
+	for (int i = 0; i < n; i++)
+		for (int c = 0; c < 3; c++)
+			map[c][i] = rgb[i*3+c];
+	dinfo->colormap = map;
+	dinfo->actual_number_of_colors = n;
+}
+
+// Copy coefficients of component, block after block.
+static void readCoefs(j_decompress_ptr dinfo, jvirt_barray_ptr *coefs, int comp, JCOEF *out) {
+	jpeg_component_info *ci = &dinfo->comp_info[comp];
+	for (JDIMENSION row = 0; row < ci->height_in_blocks; row++) {
+		JBLOCKARRAY b = (*dinfo->mem->access_virt_barray)((j_common_ptr)dinfo, coefs[comp], row, 1, FALSE);
+		memcpy(out, b[0], ci->width_in_blocks * sizeof(JBLOCK));
+		out += ci->width_in_blocks * DCTSIZE2;
+	}
+}
+
 */
 import "C"
 import (
 	"github.com/ezdiy/image/util"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
-	"log"
 	"runtime"
 	"sync"
 	"unsafe"
@@ -91,6 +110,14 @@ func (r *decoder) cleanup(abort bool) {
 	if r.dInfo.err == nil {
 		return // killed by errorPanic
 	}
+	if s, ok := r.Reader.(*Stream); ok {
+		// Keep what was read past EOI for the next image.
+		n := int(r.dInfo.src.bytes_in_buffer)
+		if n > 0 {
+			s.unread((*[bufferSize]byte)(unsafe.Pointer(r.dInfo.src.next_input_byte))[:n:n])
+		}
+		r.NBRead -= n
+	}
 	if r.DecoderOptions != nil && r.DecoderOptions.NBRead != nil {
 		*r.DecoderOptions.NBRead += r.NBRead
 	}
@@ -108,8 +135,8 @@ func (r *decoder) setBuffer(n int) {
 	r.NBRead += n
 }
 
-// Decode an image with given options.
-func DecodeImage(input io.Reader, opt *DecoderOptions) (img image.Image, err error) {
+// Get decoder reading from input.
+func getDecoder(input io.Reader) *decoder {
 	// Decoders are reused, and freed only under memory pressure.
 	r, ok := decoderPool.Get().(*decoder)
 	if !ok {
@@ -125,20 +152,122 @@ func DecodeImage(input io.Reader, opt *DecoderOptions) (img image.Image, err err
 			C.jpeg_destroy_decompress(&r.dInfo)
 		})
 	}
-
 	r.setBuffer(0)
 	r.Reader = input
+	return r
+}
+
+// Decode an image with given options.
+func DecodeImage(input io.Reader, opt *DecoderOptions) (img image.Image, err error) {
+	r := getDecoder(input)
+	defer errHandle(&err, r)
+	return r.decode(opt), nil
+}
+
+// Decode an image held in memory. libjpeg reads data directly, without copying it.
+func DecodeBytes(data []byte, opt *DecoderOptions) (img image.Image, err error) {
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r := getDecoder(noInput{})
 	defer errHandle(&err, r)
+	r.dInfo.src.next_input_byte = (*C.JOCTET)(&data[0])
+	r.dInfo.src.bytes_in_buffer = C.size_t(len(data))
+	r.NBRead = len(data)
+	img = r.decode(opt)
+	runtime.KeepAlive(data)
+	return img, nil
+}
 
-	di := &r.dInfo
+// Input past the end of DecodeBytes data.
+type noInput struct{}
+
+func (noInput) Read([]byte) (int, error) { return 0, io.EOF }
+
+// Decode image from input set up already.
+func (r *decoder) decode(opt *DecoderOptions) (img image.Image) {
 	if opt == nil {
 		opt = &DefaultDecoderOptions
 	}
+	if !r.readHeader(opt) {
+		return nil
+	}
+	di := &r.dInfo
+	scaled := r.setScale(opt.ScaleTo)
+
+	// Heuristics to choose decoder based on decoder options. Whenever raw
+	// decoder falls through, we attempt to use scanline one (if colorspace permits).
+	switch cs := di.jpeg_color_space; {
+	case opt.Quantize != nil:
+		img = r.tryPaletted(opt.Quantize)
+	case opt.Deblock != nil && r.canDeblock():
+		img = r.deblock(opt.Deblock)
+	case cs == C.JCS_GRAYSCALE:
+		if r.HasModel(color.GrayModel) && !r.NoRawDecodingGray && !scaled {
+			img = r.tryGray()
+		}
+		if img == nil {
+			if img = r.tryModel(color.GrayModel, C.JCS_GRAYSCALE); img == nil {
+				if img = r.tryModel(color.NRGBAModel, C.JCS_EXT_RGBA); img == nil {
+					img = r.tryModel(color.RGBAModel, C.JCS_EXT_RGBA)
+				}
+			}
+		}
+	case cs == C.JCS_YCbCr:
+		if r.HasModel(color.YCbCrModel) && !scaled {
+			img = r.tryYCbCr()
+		}
+		if img == nil {
+			if img = r.tryModel(color.NRGBAModel, C.JCS_EXT_RGBA); img == nil {
+				if img = r.tryModel(color.RGBAModel, C.JCS_EXT_RGBA); img == nil {
+					img = r.tryModel(color.GrayModel, C.JCS_GRAYSCALE)
+				}
+			}
+		}
+	case cs == C.JCS_RGB:
+		if img = r.tryModel(color.NRGBAModel, C.JCS_EXT_RGBA); img == nil {
+			if img = r.tryModel(color.RGBAModel, C.JCS_EXT_RGBA); img == nil {
+				img = r.tryModel(color.GrayModel, C.JCS_GRAYSCALE)
+			}
+		}
+	case cs == C.JCS_CMYK, cs == C.JCS_YCCK:
+		img = r.tryModel(color.CMYKModel, C.JCS_CMYK)
+	default:
+		throw("unknown color model %d", int(di.jpeg_color_space))
+	}
+	C.jpeg_finish_decompress(&r.dInfo)
+	r.cleanup(false)
+	return img
+}
+
+// Read header, fill outputs of options and set up decoding parameters. Returns false
+// if only Config was requested, in which case the decoder is already cleaned up.
+func (r *decoder) readHeader(opt *DecoderOptions) bool {
+	di := &r.dInfo
 	r.DecoderOptions = opt
 
+	r.saveMarkers(opt.Markers != nil)
 	if C.jpeg_read_header(&r.dInfo, 1) != 1 {
 		throw("not a JPG file")
 	}
+	if opt.Markers != nil {
+		*opt.Markers = r.markers()
+	}
+
+	if opt.Density != nil {
+		*opt.Density = Density{}
+		if di.saw_JFIF_marker != 0 {
+			*opt.Density = Density{
+				Unit: DensityUnit(di.density_unit),
+				X:    int(di.X_density),
+				Y:    int(di.Y_density),
+			}
+		}
+	}
+
+	if opt.Quality != nil {
+		*opt.Quality = r.estimateQuality()
+	}
 
 	// Config requested
 	config := opt.Config
@@ -161,54 +290,109 @@ func DecodeImage(input io.Reader, opt *DecoderOptions) (img image.Image, err err
 		config.Height = int(di.image_height)
 		// No decoding requested
 		r.cleanup(true)
-		return nil, nil
+		return false
 	}
 
 	// Parse options
 	di.dct_method = C.J_DCT_METHOD(opt.DCTMethod)
 	di.do_fancy_upsampling = bool2c(!opt.NoFancyUpsampling)
 	di.do_block_smoothing = bool2c(!opt.NoBlockSmoothing)
+	return true
+}
 
-	// Heuristics to choose decoder based on decoder options. Whenever raw
-	// decoder falls through, we attempt to use scanline one (if colorspace permits).
-	switch di.jpeg_color_space {
-	case C.JCS_GRAYSCALE:
-		if r.HasModel(color.GrayModel) && !r.NoRawDecodingGray {
-			img = r.tryGray()
-		}
-		if img == nil {
-			if img = r.tryModel(color.GrayModel, C.JCS_GRAYSCALE); img == nil {
-				if img = r.tryModel(color.NRGBAModel, C.JCS_EXT_RGBA); img == nil {
-					img = r.tryModel(color.RGBAModel, C.JCS_EXT_RGBA)
-				}
-			}
+// Pick the largest DCT scaling which keeps the image at least min big. Raw decoders
+// don't handle scaled blocks, so scanline decoding must be used if it returns true.
+func (r *decoder) setScale(min image.Point) bool {
+	di := &r.dInfo
+	denom := 1
+	if min != (image.Point{}) {
+		w, h := int(di.image_width), int(di.image_height)
+		for denom < 8 && (w+denom*2-1)/(denom*2) >= min.X && (h+denom*2-1)/(denom*2) >= min.Y {
+			denom *= 2
 		}
-	case C.JCS_YCbCr:
-		if r.HasModel(color.YCbCrModel) {
-			img = r.tryYCbCr()
+	}
+	di.scale_num = 1
+	di.scale_denom = C.uint(denom)
+	return denom > 1
+}
+
+// Estimate quality from quantization tables read with header.
+func (r *decoder) estimateQuality() QualityEstimate {
+	di := &r.dInfo
+	ci := (*[4]C.jpeg_component_info)(unsafe.Pointer(di.comp_info))
+	table := func(comp int) *[64]uint16 {
+		q := di.quant_tbl_ptrs[ci[comp].quant_tbl_no]
+		if q == nil {
+			throw("missing quantization table")
 		}
-		if img == nil {
-			if img = r.tryModel(color.NRGBAModel, C.JCS_EXT_RGBA); img == nil {
-				if img = r.tryModel(color.RGBAModel, C.JCS_EXT_RGBA); img == nil {
-					img = r.tryModel(color.GrayModel, C.JCS_GRAYSCALE)
-				}
-			}
+		var t [64]uint16
+		for i := range t {
+			t[i] = uint16(q.quantval[i])
 		}
-	case C.JCS_RGB:
-		if img = r.tryModel(color.NRGBAModel, C.JCS_EXT_RGBA); img == nil {
-			if img = r.tryModel(color.RGBAModel, C.JCS_EXT_RGBA); img == nil {
-				img = r.tryModel(color.GrayModel, C.JCS_GRAYSCALE)
-			}
+		return &t
+	}
+	var chroma *[64]uint16
+	if di.num_components >= 3 {
+		chroma = table(1)
+	}
+	return estimateQuality(table(0), chroma, baseQuantTables(), di.saw_Adobe_marker != 0)
+}
+
+// Tell libjpeg to keep (or not, as the decoder is reused) APPn and COM markers.
+func (r *decoder) saveMarkers(save bool) {
+	var limit C.uint
+	if save {
+		limit = 0xffff
+	}
+	for code := MarkerAPP0; code <= MarkerAPP15; code++ {
+		C.jpeg_save_markers(&r.dInfo, C.int(code), limit)
+	}
+	C.jpeg_save_markers(&r.dInfo, MarkerCOM, limit)
+}
+
+// Copy out the markers saved while reading header.
+func (r *decoder) markers() (res Markers) {
+	res = Markers{}
+	for m := r.dInfo.marker_list; m != nil; m = m.next {
+		res = append(res, Marker{
+			Code: byte(m.marker),
+			Data: C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length)),
+		})
+	}
+	return
+}
+
+// Header details, for Transcode.
+type header struct {
+	size        image.Point
+	quality     QualityEstimate
+	progressive bool
+	ratio       image.YCbCrSubsampleRatio // Unknown if not YCbCr
+	markers     Markers
+}
+
+// Read header of JPEG stream.
+func probe(input io.Reader) (h header, err error) {
+	r := getDecoder(input)
+	defer errHandle(&err, r)
+	r.DecoderOptions = &DefaultDecoderOptions
+	r.saveMarkers(true)
+	di := &r.dInfo
+	if C.jpeg_read_header(&r.dInfo, 1) != 1 {
+		throw("not a JPG file")
+	}
+	h.size = image.Pt(int(di.image_width), int(di.image_height))
+	h.quality = r.estimateQuality()
+	h.progressive = di.progressive_mode != 0
+	h.ratio = util.YCbCrSubsampleRatioUnknown
+	if di.jpeg_color_space == C.JCS_YCbCr {
+		if ratio, ok := r.subsampling(); ok {
+			h.ratio = ratio
 		}
-	case C.JCS_CMYK:
-	case C.JCS_YCCK:
-		img = r.tryModel(color.CMYKModel, C.JCS_CMYK)
-	default:
-		throw("unknown color model %d", int(di.jpeg_color_space))
 	}
-	C.jpeg_finish_decompress(&r.dInfo)
-	r.cleanup(false)
-	return img, nil
+	h.markers = r.markers()
+	r.cleanup(true)
+	return
 }
 
 // Compatible API to read color model and dimensions only.
@@ -217,27 +401,110 @@ func DecodeConfig(r io.Reader) (cfg image.Config, err error) {
 	return
 }
 
+// Decode into dst of the (scaled) image size, without allocating it. Gray, RGBA, NRGBA
+// and CMYK images are supported, with libjpeg converting colors, except that CMYK
+// files decode only into CMYK. OutputColorspaces, Quantize and Config are ignored,
+// Deblock is an error.
+func DecodeInto(dst draw.Image, input io.Reader, opt *DecoderOptions) (err error) {
+	if opt != nil && opt.Deblock != nil {
+		return errDeblockInto
+	}
+	r := getDecoder(input)
+	defer errHandle(&err, r)
+	if opt == nil {
+		opt = &DefaultDecoderOptions
+	}
+	o := *opt
+	o.Config = nil
+	r.readHeader(&o)
+	r.setScale(opt.ScaleTo)
+
+	di := &r.dInfo
+	switch dst.(type) {
+	case *image.Gray:
+		di.out_color_space = C.JCS_GRAYSCALE
+	case *image.RGBA, *image.NRGBA:
+		di.out_color_space = C.JCS_EXT_RGBA
+	case *image.CMYK:
+		di.out_color_space = C.JCS_CMYK
+	default:
+		throw("can't decode into %T", dst)
+	}
+	C.jpeg_calc_output_dimensions(&r.dInfo)
+	size := image.Pt(int(di.output_width), int(di.output_height))
+	if dst.Bounds().Size() != size {
+		throw("destination of %v, image of %v", dst.Bounds().Size(), size)
+	}
+	pix, stride := util.GetPixStride(dst)
+	if len(pix) < (size.Y-1)*stride+size.X*int(di.out_color_components) {
+		throw("destination buffer of %d bytes too short", len(pix))
+	}
+	C.jpeg_start_decompress(&r.dInfo)
+	C.decodeScan(&r.dInfo, (*C.uchar)(unsafe.Pointer(&pix[0])), C.int(stride))
+	C.jpeg_finish_decompress(&r.dInfo)
+	r.cleanup(false)
+	return nil
+}
+
+// Decode YCbCr file into planes of dst, without allocating them. The file must be of
+// dst size and subsampling ratio, and ScaleTo isn't supported. libjpeg writes whole
+// 8x8 blocks, so strides and plane lengths must cover plane sizes rounded up to 8.
+// dst.Rect.Min must be aligned to the subsampling. Deblock is an error.
+func DecodeYCbCrInto(dst *image.YCbCr, input io.Reader, opt *DecoderOptions) (err error) {
+	if opt != nil && opt.Deblock != nil {
+		return errDeblockInto
+	}
+	r := getDecoder(input)
+	defer errHandle(&err, r)
+	if opt == nil {
+		opt = &DefaultDecoderOptions
+	}
+	o := *opt
+	o.Config = nil
+	r.readHeader(&o)
+
+	di := &r.dInfo
+	ratio, ok := r.rawSubsampling()
+	if di.jpeg_color_space != C.JCS_YCbCr || !ok {
+		throw("file can't be decoded into image.YCbCr")
+	}
+	if ratio != dst.SubsampleRatio {
+		throw("file subsampled %v, destination %v", ratio, dst.SubsampleRatio)
+	}
+	if v, h := util.SSR2VHDiv(ratio); dst.Rect.Min.X%h != 0 || dst.Rect.Min.Y%v != 0 {
+		throw("destination at %v not aligned to subsampling", dst.Rect.Min)
+	}
+	if size := image.Pt(int(di.image_width), int(di.image_height)); dst.Rect.Size() != size {
+		throw("destination of %v, image of %v", dst.Rect.Size(), size)
+	}
+	r.rawDecodeYCbCr(dst)
+	C.jpeg_finish_decompress(&r.dInfo)
+	r.cleanup(false)
+	return nil
+}
+
 // Compatible API, decodes with default options.
 func Decode(i io.Reader) (img image.Image, err error) {
 	return DecodeImage(i, nil)
 }
 
-// Attempt a raw decode given a list of strides for each component.
-func (r *decoder) rawDecode(buf []byte, strides []int32) {
+// Raw decode into planes of given strides, one for each component.
+func (r *decoder) rawDecode(planes [][]byte, strides []int32) {
+	di := &r.dInfo
+	ci := (*[3]C.jpeg_component_info)(unsafe.Pointer(di.comp_info))
+	var ptrs [3]*C.uchar
+	for i, p := range planes {
+		// libjpeg writes whole blocks, up to the last row which has some.
+		w := alignto(int(ci[i].downsampled_width), dctSize)
+		h := alignto(int(ci[i].downsampled_height), dctSize)
+		if int(strides[i]) < w || len(p) < (h-1)*int(strides[i])+w {
+			throw("plane %d of stride %d and %d bytes, need %dx%d blocks", i, strides[i], len(p), w/dctSize, h/dctSize)
+		}
+		ptrs[i] = (*C.uchar)(unsafe.Pointer(&p[0]))
+	}
 	r.dInfo.raw_data_out = 1
 	C.jpeg_start_decompress(&r.dInfo)
-
-	// Decompress
-	iMCUs := int32(C.decodeRaw(&r.dInfo, (*C.uchar)(unsafe.Pointer(&buf[0])), (*C.int)(unsafe.Pointer(&strides[0]))))
-
-	// Check that we didn't screw up the dimensions calc
-	var got int
-	for _, v := range strides {
-		got += int(v * iMCUs)
-	}
-	if got != len(buf) {
-		log.Fatalf("misaligned decode %d != %d. process memory corrupted!\n", got, len(buf))
-	}
+	C.decodeRaw(&r.dInfo, ptrs[0], ptrs[1], ptrs[2], (*C.int)(unsafe.Pointer(&strides[0])))
 }
 
 // Attempt to raw decode grayscale picture.
@@ -261,7 +528,7 @@ func (r *decoder) tryGray() (img image.Image) {
 		Rect:   image.Rect(0, 0, int(di.image_width), int(di.image_height)),
 	}
 
-	r.rawDecode(buf, []int32{int32(Stride)})
+	r.rawDecode([][]byte{buf}, []int32{int32(Stride)})
 	return
 }
 
@@ -270,42 +537,9 @@ func (r *decoder) tryYCbCr() (img image.Image) {
 	di := &r.dInfo
 	ci := (*[3]C.jpeg_component_info)(unsafe.Pointer(di.comp_info))
 
-	// Must have 3 components
-	if di.num_components != 3 {
-		return
-	}
-
-	// Must fit the MCU membership array.
-	for i := 0; i < 3; i++ {
-		// Ancient PSP9 and PS3 files with Y=4x4, C=2x2 for example.
-		// Raise D_MAX_BLOCKS_IN_MCU in jconfig.h and recompile jpeglib if you need that.
-		mcublks := uintptr(di.blocks_in_MCU + ci[i].h_samp_factor*ci[i].v_samp_factor)
-		if mcublks > unsafe.Sizeof(di.MCU_membership)/C.sizeof_int {
-			return
-		}
-	}
-
-	yv, yh := ci[0].v_samp_factor, ci[0].h_samp_factor
-	cv, ch := ci[1].v_samp_factor, ci[1].h_samp_factor
-
-	// Sampling for both chroma must be same
-	if ci[2].v_samp_factor != cv || ci[2].h_samp_factor != ch {
-		return
-	}
-
-	// Luma must have (1 or more times) multiple of chroma samples more
-	// TODO: what about not-of-2 powers?
-	if yv%cv != 0 || yh%ch != 0 {
-		return
-	}
-
-	// Scale down to ratio
-	yv /= cv
-	yh /= ch
-
 	// Must be of known and whitelisted subsampling ratio
-	ratio := util.VHDiv2SSR(int(yv), int(yh))
-	if !r.HasSSR(ratio) {
+	ratio, ok := r.rawSubsampling()
+	if !ok || !r.HasSSR(ratio) {
 		return
 	}
 
@@ -320,7 +554,7 @@ func (r *decoder) tryYCbCr() (img image.Image) {
 
 	// Allocate the picture
 	buf := alignedBuf(bufSize)
-	img = &image.YCbCr{
+	ycc := &image.YCbCr{
 		Y:              buf[:YSize],
 		Cb:             buf[YSize:][:CSize],
 		Cr:             buf[YSize+CSize:][:CSize],
@@ -329,9 +563,63 @@ func (r *decoder) tryYCbCr() (img image.Image) {
 		CStride:        CStride,
 		Rect:           image.Rect(0, 0, int(di.image_width), int(di.image_height)),
 	}
+	r.rawDecodeYCbCr(ycc)
+	return ycc
+}
 
-	r.rawDecode(buf, []int32{int32(YStride), int32(CStride), int32(CStride)})
-	return
+// Subsampling ratio of YCbCr file, if it can be decoded raw.
+func (r *decoder) rawSubsampling() (ratio image.YCbCrSubsampleRatio, ok bool) {
+	di := &r.dInfo
+	ci := (*[3]C.jpeg_component_info)(unsafe.Pointer(di.comp_info))
+
+	// Must have 3 components
+	if di.num_components != 3 {
+		return
+	}
+
+	// Must fit the MCU membership array. Counted from sampling factors, as blocks_in_MCU
+	// isn't set until decompression starts, and is left over from the last file till then.
+	mcublks := uintptr(0)
+	for i := 0; i < 3; i++ {
+		mcublks += uintptr(ci[i].h_samp_factor * ci[i].v_samp_factor)
+	}
+	// Ancient PSP9 and PS3 files with Y=4x4, C=2x2 for example.
+	// Raise D_MAX_BLOCKS_IN_MCU in jconfig.h and recompile jpeglib if you need that.
+	if mcublks > unsafe.Sizeof(di.MCU_membership)/C.sizeof_int {
+		return
+	}
+	return r.subsampling()
+}
+
+// Raw decode into planes of ycc, which must match the file.
+func (r *decoder) rawDecodeYCbCr(ycc *image.YCbCr) {
+	r.rawDecode([][]byte{ycc.Y, ycc.Cb, ycc.Cr}, []int32{int32(ycc.YStride), int32(ycc.CStride), int32(ycc.CStride)})
+}
+
+// Subsampling ratio of 3 component file, if image.YCbCr can represent it.
+func (r *decoder) subsampling() (ratio image.YCbCrSubsampleRatio, ok bool) {
+	di := &r.dInfo
+	if di.num_components != 3 {
+		return
+	}
+	ci := (*[3]C.jpeg_component_info)(unsafe.Pointer(di.comp_info))
+	yv, yh := ci[0].v_samp_factor, ci[0].h_samp_factor
+	cv, ch := ci[1].v_samp_factor, ci[1].h_samp_factor
+
+	// Sampling for both chroma must be same
+	if ci[2].v_samp_factor != cv || ci[2].h_samp_factor != ch {
+		return
+	}
+
+	// Luma must have (1 or more times) multiple of chroma samples more
+	// TODO: what about not-of-2 powers?
+	if yv%cv != 0 || yh%ch != 0 {
+		return
+	}
+
+	// Scale down to ratio
+	ratio = util.VHDiv2SSR(int(yv/cv), int(yh/ch))
+	return ratio, ratio != util.YCbCrSubsampleRatioUnknown
 }
 
 // Decode using a scan line decoder with post-processing into target colorspace.
@@ -350,7 +638,7 @@ func (r *decoder) tryModel(model color.Model, cs C.J_COLOR_SPACE) (img image.Ima
 	C.jpeg_start_decompress(&r.dInfo)
 
 	// Create image
-	img = util.NewImage(model, image.Rect(0, 0, int(di.image_width), int(di.image_height)))
+	img = util.NewImage(model, image.Rect(0, 0, int(di.output_width), int(di.output_height)))
 	pix, stride := util.GetPixStride(img)
 	if pix == nil {
 		return nil
@@ -361,6 +649,135 @@ func (r *decoder) tryModel(model color.Model, cs C.J_COLOR_SPACE) (img image.Ima
 	return
 }
 
+// Decode into palette, using libjpeg color quantization.
+func (r *decoder) tryPaletted(q *Quantize) image.Image {
+	di := &r.dInfo
+	if q.Dither < DitherFS || q.Dither > DitherNone {
+		throw("unknown dither mode %d", int(q.Dither))
+	}
+	di.quantize_colors = 1
+	di.two_pass_quantize = bool2c(!q.OnePass)
+	di.dither_mode = [...]C.J_DITHER_MODE{DitherFS: C.JDITHER_FS, DitherOrdered: C.JDITHER_ORDERED, DitherNone: C.JDITHER_NONE}[q.Dither]
+	di.desired_number_of_colors = 256
+	if q.Colors > 0 {
+		di.desired_number_of_colors = C.int(q.Colors)
+	}
+
+	switch di.jpeg_color_space {
+	case C.JCS_CMYK, C.JCS_YCCK:
+		if len(q.Palette) > 0 {
+			throw("can't quantize CMYK into a fixed palette")
+		}
+		di.out_color_space = C.JCS_CMYK
+	case C.JCS_GRAYSCALE:
+		if len(q.Palette) == 0 {
+			di.out_color_space = C.JCS_GRAYSCALE
+			break
+		}
+		fallthrough // Fixed palette needs 3 components
+	default:
+		di.out_color_space = C.JCS_RGB
+	}
+	if n := len(q.Palette); n > 0 {
+		if n > 256 {
+			throw("palette of %d colors", n)
+		}
+		rgb := make([]byte, 0, n*3)
+		for _, c := range q.Palette {
+			r, g, b, _ := c.RGBA()
+			rgb = append(rgb, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+		C.setColormap(&r.dInfo, (*C.uchar)(&rgb[0]), C.int(n))
+	}
+	C.jpeg_start_decompress(&r.dInfo)
+
+	// The palette libjpeg ended up with.
+	pal := q.Palette
+	if len(pal) == 0 {
+		cmap := (*[4]*[256]C.JSAMPLE)(unsafe.Pointer(di.colormap))
+		pal = make(color.Palette, int(di.actual_number_of_colors))
+		for i := range pal {
+			switch di.out_color_components {
+			case 1:
+				pal[i] = color.Gray{uint8(cmap[0][i])}
+			case 3:
+				pal[i] = color.RGBA{uint8(cmap[0][i]), uint8(cmap[1][i]), uint8(cmap[2][i]), 0xff}
+			default:
+				pal[i] = color.CMYK{uint8(cmap[0][i]), uint8(cmap[1][i]), uint8(cmap[2][i]), uint8(cmap[3][i])}
+			}
+		}
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, int(di.output_width), int(di.output_height)), pal)
+	C.decodeScan(&r.dInfo, (*C.uchar)(unsafe.Pointer(&img.Pix[0])), C.int(img.Stride))
+	return img
+}
+
+// Whether Deblock applies to the file.
+func (r *decoder) canDeblock() bool {
+	switch r.dInfo.jpeg_color_space {
+	case C.JCS_GRAYSCALE:
+		return r.dInfo.num_components == 1
+	case C.JCS_YCbCr:
+		_, ok := r.subsampling()
+		return ok
+	}
+	return false
+}
+
+// Decode with deblocking, from coefficients.
+func (r *decoder) deblock(opt *Deblock) image.Image {
+	di := &r.dInfo
+	coefs := C.jpeg_read_coefficients(&r.dInfo)
+	ci := (*[3]C.jpeg_component_info)(unsafe.Pointer(di.comp_info))
+	planes := make([][]byte, di.num_components)
+	strides := make([]int, len(planes))
+	for c := range planes {
+		w, h := int(ci[c].width_in_blocks), int(ci[c].height_in_blocks)
+		qt := ci[c].quant_table
+		if qt == nil {
+			throw("missing quantization table")
+		}
+		var q [64]uint16
+		for i := range q {
+			q[i] = uint16(qt.quantval[i])
+		}
+		coef := make([]int16, w*h*dctSize*dctSize)
+		C.readCoefs(&r.dInfo, coefs, C.int(c), (*C.JCOEF)(unsafe.Pointer(&coef[0])))
+		planes[c], strides[c] = deblockPlane(coef, &q, w, h, opt), w*dctSize
+	}
+
+	rect := image.Rect(0, 0, int(di.image_width), int(di.image_height))
+	var img image.Image
+	if len(planes) == 1 {
+		img = &image.Gray{Pix: planes[0], Stride: strides[0], Rect: rect}
+		if r.HasModel(color.GrayModel) {
+			return img
+		}
+	} else {
+		ratio, _ := r.subsampling()
+		img = &image.YCbCr{
+			Y: planes[0], Cb: planes[1], Cr: planes[2],
+			YStride: strides[0], CStride: strides[1],
+			SubsampleRatio: ratio,
+			Rect:           rect,
+		}
+		if r.HasModel(color.YCbCrModel) && r.HasSSR(ratio) {
+			return img
+		}
+		if !r.HasModel(color.NRGBAModel) && !r.HasModel(color.RGBAModel) && r.HasModel(color.GrayModel) {
+			// Luma only, as libjpeg does it.
+			return &image.Gray{Pix: planes[0], Stride: strides[0], Rect: rect}
+		}
+	}
+	for _, m := range []color.Model{color.NRGBAModel, color.RGBAModel} {
+		if r.HasModel(m) {
+			return util.ToModel(img, m)
+		}
+	}
+	return nil
+}
+
 func init() {
 	image.RegisterFormat("jpeg", "\xff\xd8", Decode, DecodeConfig)
 }
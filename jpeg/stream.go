@@ -0,0 +1,95 @@
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+var (
+	errStreamConfig = errors.New("jpeg: Config can't be used with Stream")
+	soi             = []byte{0xff, 0xd8}
+)
+
+// Stream of JPEG files back to back, such as Motion JPEG sent by IP cameras. Decoding
+// stops right after EOI of each image, and bytes read past it stay buffered for the
+// next one. Anything between images is skipped. Stream reads like the underlying
+// reader, buffered bytes first, for whatever else sits between images.
+type Stream struct {
+	r          io.Reader
+	buf, spare []byte // Read ahead, but not decoded yet
+	pos        int    // Of unread part of buf
+}
+
+func NewStream(r io.Reader) *Stream {
+	return &Stream{r: r}
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.pos < len(s.buf) {
+		n := copy(p, s.buf[s.pos:])
+		s.pos += n
+		return n, nil
+	}
+	return s.r.Read(p)
+}
+
+// Put back bytes read ahead, in front of what is buffered already.
+func (s *Stream) unread(b []byte) {
+	s.spare = append(append(s.spare[:0], b...), s.buf[s.pos:]...)
+	s.buf, s.spare, s.pos = s.spare, s.buf, 0
+}
+
+// Skip to the next SOI. Returns io.EOF if there's none.
+func (s *Stream) next(opt *DecoderOptions) error {
+	if opt != nil && opt.Config != nil {
+		return errStreamConfig
+	}
+	for {
+		if i := bytes.Index(s.buf[s.pos:], soi); i >= 0 {
+			s.pos += i
+			return nil
+		}
+		// Keep 0xff which may be the start of SOI.
+		keep := 0
+		if s.pos < len(s.buf) && s.buf[len(s.buf)-1] == 0xff {
+			keep = 1
+		}
+		s.buf = s.buf[:copy(s.buf, s.buf[len(s.buf)-keep:])]
+		s.pos = 0
+		if cap(s.buf) < 4096 {
+			s.buf = append(make([]byte, 0, 4096), s.buf...)
+		}
+		n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+n]
+		if n == 0 && err != nil {
+			return err
+		}
+	}
+}
+
+// Decode next image, see DecodeImage. Returns io.EOF at the end of stream.
+func (s *Stream) Decode(opt *DecoderOptions) (image.Image, error) {
+	if err := s.next(opt); err != nil {
+		return nil, err
+	}
+	return DecodeImage(s, opt)
+}
+
+// Decode next image into dst, see DecodeInto. Returns io.EOF at the end of stream.
+func (s *Stream) DecodeInto(dst draw.Image, opt *DecoderOptions) error {
+	if err := s.next(nil); err != nil {
+		return err
+	}
+	return DecodeInto(dst, s, opt)
+}
+
+// Decode next image into dst, see DecodeYCbCrInto. Returns io.EOF at the end of stream.
+func (s *Stream) DecodeYCbCrInto(dst *image.YCbCr, opt *DecoderOptions) error {
+	if err := s.next(nil); err != nil {
+		return err
+	}
+	return DecodeYCbCrInto(dst, s, opt)
+}
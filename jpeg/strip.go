@@ -0,0 +1,83 @@
+package jpeg
+
+import (
+	"bytes"
+	"github.com/ezdiy/image/exif"
+	"github.com/ezdiy/image/xmp"
+	"io"
+	"io/ioutil"
+)
+
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// Metadata kept by Strip. JFIF and Adobe segments are always kept, as they tell how
+// to interpret colors.
+type Keep struct {
+	ICC         bool // ICC profile
+	EXIF        bool // All of EXIF
+	Orientation bool // Only the Orientation tag of EXIF, in an EXIF segment of its own
+	XMP         bool // XMP, including Extended XMP
+
+	// If set, other APPn and COM segments for which it returns true are kept too.
+	Segment func(code byte, data []byte) bool
+}
+
+// Copy JPEG stream, removing APPn and COM segments except the ones in keep, and
+// anything after EOI. This includes further images of a multi-picture file. Image
+// data is copied as-is, without decoding, so nothing is lost. nil keep removes all.
+func Strip(w io.Writer, r io.Reader, keep *Keep) error {
+	if keep == nil {
+		keep = &Keep{}
+	}
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	info := &Info{}
+	if err = info.parse(in); err != nil {
+		return err
+	}
+	eoi := info.Markers[len(info.Markers)-1]
+	in = in[:eoi.Offset+eoi.Length]
+
+	var orientation []byte
+	out, err := stripSegments(in, func(code byte, data []byte) []byte {
+		isEXIF := code == MarkerAPP1 && bytes.HasPrefix(data, exif.Header)
+		switch {
+		case keepStructural(code, data),
+			keep.ICC && code == MarkerAPP2 && bytes.HasPrefix(data, iccHeader),
+			keep.EXIF && isEXIF,
+			keep.XMP && code == MarkerAPP1 && (bytes.HasPrefix(data, xmp.Header) || bytes.HasPrefix(data, xmp.ExtendedHeader)),
+			keep.Segment != nil && keep.Segment(code, data):
+			return data
+		case keep.Orientation && isEXIF && orientation == nil:
+			orientation = onlyOrientation(data)
+			return orientation
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// EXIF payload holding just the orientation of data, or nil if there is none.
+// Broken EXIF goes away too.
+func onlyOrientation(data []byte) []byte {
+	e, err := exif.Parse(data)
+	if err != nil {
+		return nil
+	}
+	t, ok := e.Get(exif.IFD0, exif.TagOrientation)
+	if !ok {
+		return nil
+	}
+	o := exif.New(e.Order)
+	if o.Set(exif.IFD0, t) != nil {
+		return nil
+	}
+	b, _ := o.Marshal()
+	return b
+}
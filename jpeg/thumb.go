@@ -0,0 +1,129 @@
+package jpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ezdiy/image/exif"
+	"image"
+	"io"
+)
+
+// Make a JPEG thumbnail fitting size, for use with exif.Exif.SetThumbnail.
+// Options are for encoding the thumbnail, nil means defaults.
+func Thumbnail(img image.Image, size image.Point, opt *Options) ([]byte, error) {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	o.Markers, o.Thumbnail, o.NBWritten, o.Grayscale = nil, image.Point{}, nil, nil
+	var buf bytes.Buffer
+	if err := Encode(&buf, shrink(img, size, newBlender(o.Alpha, o.Background)), &o); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Make a thumbnail out of JPEG stream, using scaled decoding.
+func ThumbnailFrom(r io.Reader, size image.Point, opt *Options) ([]byte, error) {
+	img, err := DecodeImage(r, &DecoderOptions{ScaleTo: size})
+	if err != nil {
+		return nil, err
+	}
+	return Thumbnail(img, size, opt)
+}
+
+// Box filter the image down to fit size, keeping aspect ratio.
+func shrink(img image.Image, size image.Point, bl *blender) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > size.X || h > size.Y {
+		if w*size.Y > h*size.X {
+			dw, dh = size.X, (h*size.X+w/2)/w
+		} else {
+			dw, dh = (w*size.Y+h/2)/h, size.Y
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	conv, ncomp := newRowConverter(img, bl)
+	xmap := make([]int, w)
+	xcount := make([]uint32, dw)
+	for x := range xmap {
+		xmap[x] = x * dw / w
+		xcount[xmap[x]]++
+	}
+	sums := make([]uint32, dw*dh*ncomp)
+	ycount := make([]uint32, dh)
+	row := make([]byte, w*ncomp)
+	for y := 0; y < h; y++ {
+		dy := y * dh / h
+		ycount[dy]++
+		conv(row, b.Min.Y+y)
+		sum := sums[dy*dw*ncomp:]
+		for x, dx := range xmap {
+			for c := 0; c < ncomp; c++ {
+				sum[dx*ncomp+c] += uint32(row[x*ncomp+c])
+			}
+		}
+	}
+
+	var pix []byte
+	var res image.Image
+	if ncomp == 1 {
+		g := image.NewGray(image.Rect(0, 0, dw, dh))
+		pix, res = g.Pix, g
+	} else {
+		rgba := image.NewRGBA(image.Rect(0, 0, dw, dh))
+		pix, res = rgba.Pix, rgba
+	}
+	bpp := len(pix) / (dw * dh)
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			n := xcount[dx] * ycount[dy]
+			i := dy*dw + dx
+			for c := 0; c < ncomp; c++ {
+				pix[i*bpp+c] = byte((sums[i*ncomp+c] + n/2) / n)
+			}
+			if bpp == 4 {
+				pix[i*bpp+3] = 0xff
+			}
+		}
+	}
+	return res
+}
+
+// Put thumbnail of img into EXIF among markers, creating the EXIF segment if there's none.
+func addThumbnail(img image.Image, opt *Options) (Markers, error) {
+	thumb, err := Thumbnail(img, opt.Thumbnail, opt)
+	if err != nil {
+		return nil, err
+	}
+	res := append(Markers(nil), opt.Markers...)
+	for i, m := range res {
+		if m.Code == MarkerAPP1 && bytes.HasPrefix(m.Data, exif.Header) {
+			e, err := exif.Parse(m.Data)
+			if err != nil {
+				return nil, err
+			}
+			e.SetThumbnail(thumb)
+			if res[i].Data, err = e.Marshal(); err != nil {
+				return nil, err
+			}
+			return res, nil
+		}
+	}
+	e := exif.New(binary.BigEndian)
+	e.SetThumbnail(thumb)
+	app1, err := e.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	// EXIF is supposed to come right after SOI (or JFIF).
+	return append(Markers{{MarkerAPP1, app1}}, res...), nil
+}
@@ -0,0 +1,226 @@
+package jpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/ezdiy/image/util"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// What Transcode did.
+type TranscodeAction int
+
+const (
+	ActionPassThrough TranscodeAction = iota // Input copied as-is
+	ActionOptimize                           // Rewritten losslessly, see Optimize
+	ActionStrip                              // Metadata segments removed, the rest copied
+	ActionReencode                           // Decoded and encoded again
+)
+
+var actionNames = []string{"pass-through", "optimize", "strip", "re-encode"}
+
+func (a TranscodeAction) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return "unknown"
+	}
+	return actionNames[a]
+}
+
+// Decides what Transcode does. Zero value re-encodes files of quality above 75, and
+// otherwise optimizes them losslessly, keeping metadata.
+type Policy struct {
+	// Target of re-encoding. Quality of the input is compared to Quality, and its
+	// subsampling to Subsampling, if UseSubsampling is set. StripMetadata drops APPn
+	// and COM segments always, NoProgressive and ArithmeticCoding apply to Optimize too.
+	Options
+
+	// Re-encode only if the estimated quality exceeds the target by more than this.
+	QualityMargin int
+
+	// Strip metadata if APPn and COM segments take more than this many bytes. 0 is no limit.
+	MaxMetadata int
+
+	// Don't rewrite losslessly, only pass through, strip or re-encode. Implied when
+	// built without cgo.
+	NoOptimize bool
+}
+
+// Outcome of Transcode.
+type TranscodeResult struct {
+	Action TranscodeAction
+
+	// What the input looks like.
+	Size        image.Point
+	Quality     QualityEstimate
+	Progressive bool
+	Subsampling image.YCbCrSubsampleRatio // util.YCbCrSubsampleRatioUnknown if not YCbCr
+	Metadata    int                       // Bytes taken by APPn and COM segments
+
+	In, Out int // Bytes read and written
+}
+
+// Bytes saved, negative if the output grew.
+func (r *TranscodeResult) Savings() int {
+	return r.In - r.Out
+}
+
+// Read JPEG stream, decide what to do with it according to policy, and write the result.
+// Re-encoding or optimizing which doesn't make the file smaller is dropped for the next
+// best action, so the output never grows, unless metadata was added via Markers.
+func Transcode(w io.Writer, r io.Reader, policy *Policy) (res TranscodeResult, err error) {
+	if policy == nil {
+		policy = &Policy{}
+	}
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	h, err := probe(bytes.NewReader(in))
+	if err != nil {
+		return
+	}
+	res = TranscodeResult{
+		Size:        h.size,
+		Quality:     h.quality,
+		Progressive: h.progressive,
+		Subsampling: h.ratio,
+		In:          len(in),
+	}
+	for _, m := range h.markers {
+		res.Metadata += len(m.Data) + 4
+	}
+	strip := policy.StripMetadata || (policy.MaxMetadata > 0 && res.Metadata > policy.MaxMetadata)
+
+	target := policy.Quality
+	if target <= 0 {
+		target = 75
+	}
+	q := h.quality.Luma
+	if h.quality.Chroma > q {
+		q = h.quality.Chroma
+	}
+	finer := false
+	if policy.UseSubsampling && h.ratio != util.YCbCrSubsampleRatioUnknown {
+		fv, fh := util.SSR2VHDiv(h.ratio)
+		tv, th := util.SSR2VHDiv(policy.Subsampling)
+		finer = fv*fh < tv*th
+	}
+
+	var out []byte
+	if q > target+policy.QualityMargin || finer {
+		if out, err = reencode(in, h, strip, finer, &policy.Options); err != nil {
+			return
+		}
+		res.Action = ActionReencode
+	}
+	if (out == nil || len(out) >= len(in)) && !policy.NoOptimize {
+		opt := Options{
+			NoProgressive:    policy.NoProgressive,
+			ArithmeticCoding: policy.ArithmeticCoding,
+			Ext:              policy.Ext,
+			Markers:          policy.Markers,
+			StripMetadata:    strip,
+		}
+		var buf bytes.Buffer
+		switch err = Optimize(&buf, bytes.NewReader(in), &opt); {
+		case errors.Is(err, ErrNoCgo):
+			err = nil // Not available, the file goes through as it is
+		case err != nil:
+			return
+		default:
+			out, res.Action = buf.Bytes(), ActionOptimize
+		}
+	}
+	if out == nil || len(out) >= len(in) {
+		out, res.Action = in, ActionPassThrough
+		if strip {
+			if out, err = stripSegments(in, func(code byte, data []byte) []byte {
+				if keepStructural(code, data) {
+					return data
+				}
+				return nil
+			}); err != nil {
+				return
+			}
+			res.Action = ActionStrip
+		}
+	}
+	n, err := w.Write(out)
+	res.Out = n
+	return
+}
+
+// Keep segments needed to interpret the image data.
+func keepStructural(code byte, data []byte) bool {
+	return (code == MarkerAPP0 && bytes.HasPrefix(data, []byte("JFIF\x00"))) ||
+		(code == MarkerAPP14 && bytes.HasPrefix(data, []byte("Adobe")))
+}
+
+// Decode and encode again, carrying metadata along.
+func reencode(in []byte, h header, strip, resample bool, opt *Options) ([]byte, error) {
+	dopt := DefaultDecoderOptions
+	if resample {
+		// image.YCbCr would be written with its own subsampling.
+		dopt.OutputColorspaces = []color.Model{color.GrayModel, color.RGBAModel, color.CMYKModel}
+	}
+	img, err := DecodeImage(bytes.NewReader(in), &dopt)
+	if err != nil {
+		return nil, err
+	}
+	o := *opt
+	o.Markers = nil
+	if !strip {
+		for _, m := range h.markers {
+			if !keepStructural(m.Code, m.Data) {
+				o.Markers = append(o.Markers, m)
+			}
+		}
+	}
+	o.Markers = append(o.Markers, opt.Markers...)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &o); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var errSegments = errors.New("jpeg: malformed segments")
+
+// Drop APPn and COM segments of the header, unless keep returns payload to write
+// in their place. The rest is copied as-is.
+func stripSegments(in []byte, keep func(code byte, data []byte) []byte) ([]byte, error) {
+	if !bytes.HasPrefix(in, []byte{0xff, 0xd8}) {
+		return nil, util.ErrNotJPEG
+	}
+	out := append([]byte(nil), in[:2]...)
+	pos := 2
+	for {
+		if pos+4 > len(in) || in[pos] != 0xff {
+			return nil, errSegments
+		}
+		code := in[pos+1]
+		if code == 0xff {
+			pos++ // Fill byte
+			continue
+		}
+		if code == 0xda || code == 0xd9 {
+			return append(out, in[pos:]...), nil
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(in[pos+2:]))
+		if end > len(in) || end < pos+4 {
+			return nil, errSegments
+		}
+		isMeta := (code >= MarkerAPP0 && code <= MarkerAPP15) || code == MarkerCOM
+		if !isMeta {
+			out = append(out, in[pos:end]...)
+		} else if data := keep(code, in[pos+4:end]); data != nil {
+			out = append(out, 0xff, code, byte((len(data)+2)>>8), byte(len(data)+2))
+			out = append(out, data...)
+		}
+		pos = end
+	}
+}
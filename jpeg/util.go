@@ -13,6 +13,7 @@ void nop(void *p) {};
 extern boolean fillInputBuffer(j_decompress_ptr cinfo);
 extern void skipInputData(j_decompress_ptr cinfo, long n);
 extern boolean outputBuffer(j_decompress_ptr cinfo);
+extern void termDestination(j_compress_ptr cinfo);
 extern void errorPanic(const char *msg);
 
 void errorHandler(j_common_ptr cptr) {
@@ -42,6 +43,18 @@ const (
 
 type cleanup interface{ cleanup(abort bool) }
 
+// Several objects in use at once, such as when transcoding.
+type cleanups []cleanup
+
+func (cs cleanups) cleanup(abort bool) {
+	for _, c := range cs {
+		c.cleanup(abort)
+	}
+}
+
+// Error of the underlying reader or writer, panicked by callbacks.
+type ioError struct{ error }
+
 // libjpeg doesn't support normal error propagation from callbacks,
 // so we abuse panic for a bit.
 func errHandle(err *error, closer cleanup) {
@@ -49,13 +62,21 @@ func errHandle(err *error, closer cleanup) {
 	if r == nil {
 		return
 	}
-	msg, ok := r.(string)
-	// not a thrown string, or not our prefix, panic for real now
-	if !ok || !strings.HasPrefix(msg, errPrefix) {
+	var e error
+	switch v := r.(type) {
+	case ioError:
+		e = v.error
+	case string:
+		// not our prefix, panic for real now
+		if !strings.HasPrefix(v, errPrefix) {
+			panic(r)
+		}
+		e = errors.New(v)
+	default:
 		panic(r)
 	}
 	if err != nil {
-		*err = errors.New(msg)
+		*err = e
 	}
 	if closer != nil {
 		closer.cleanup(true)
@@ -84,7 +105,7 @@ func makeCallbacks() *callbacks {
 		dst: C.struct_jpeg_destination_mgr{
 			init_destination:    (*[0]byte)(C.nop),
 			empty_output_buffer: (*[0]byte)(C.outputBuffer),
-			term_destination:    (*[0]byte)(C.outputBuffer),
+			term_destination:    (*[0]byte)(C.termDestination),
 		},
 	}
 	C.jpeg_std_error(&cb.err)
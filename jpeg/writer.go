@@ -28,14 +28,29 @@ static void encodeScan(j_compress_ptr cinfo, unsigned char *buf, int stride) {
 		i += jpeg_write_scanlines(cinfo, &outbufs[i], cinfo->image_height-i);
 }
 
-#ifndef JPEG_C_PARAM_SUPPORTED
-// The header could be just wrong, so make em weak.
+static void encodeRow(j_compress_ptr cinfo, unsigned char *row) {
+	jpeg_write_scanlines(cinfo, &row, 1);
+}
+
+#ifdef JPEG_C_PARAM_SUPPORTED
+static int haveCParams(void) { return 1; }
+#else
 typedef int J_BOOLEAN_PARAM;
 typedef int J_FLOAT_PARAM;
 typedef int J_INT_PARAM;
-void  __attribute__((weak)) jpeg_c_set_bool_param(j_compress_ptr cinfo, J_BOOLEAN_PARAM param, boolean value) { }
-void  __attribute__((weak)) jpeg_c_set_float_param(j_compress_ptr cinfo, J_FLOAT_PARAM param, float value) { }
-void  __attribute__((weak)) jpeg_c_set_int_param(j_compress_ptr cinfo, J_INT_PARAM param, int value) { }
+#ifdef _WIN32
+// No weak references in PE, so believe the headers.
+static void jpeg_c_set_bool_param(j_compress_ptr cinfo, J_BOOLEAN_PARAM param, boolean value) { }
+static void jpeg_c_set_float_param(j_compress_ptr cinfo, J_FLOAT_PARAM param, float value) { }
+static void jpeg_c_set_int_param(j_compress_ptr cinfo, J_INT_PARAM param, int value) { }
+static int haveCParams(void) { return 0; }
+#else
+// The headers could be just wrong, so look the setters up weakly. NULL if missing.
+extern void __attribute__((weak)) jpeg_c_set_bool_param(j_compress_ptr cinfo, J_BOOLEAN_PARAM param, boolean value);
+extern void __attribute__((weak)) jpeg_c_set_float_param(j_compress_ptr cinfo, J_FLOAT_PARAM param, float value);
+extern void __attribute__((weak)) jpeg_c_set_int_param(j_compress_ptr cinfo, J_INT_PARAM param, int value);
+static int haveCParams(void) { return jpeg_c_set_int_param != NULL; }
+#endif
 #endif
 
 */
@@ -43,15 +58,45 @@ import "C"
 import (
 	"github.com/ezdiy/image/util"
 	"image"
-	"image/color"
 	"io"
+	"math"
 	"runtime"
 	"sync"
 	"unsafe"
 )
 
+// mozjpeg parameter IDs.
+const (
+	paramOptimizeScans        = 0x680C061E
+	paramTrellis              = 0xC5122033
+	paramTrellisDC            = 0x339D4C0C
+	paramOptimizeEOB          = 0xD7F73780
+	paramLambdaWeight         = 0x339DB65F
+	paramTrellisUseScans      = 0xFD841435
+	paramTrellisQuant         = 0xE12AE269
+	paramDeringing            = 0x3F4BBBF9
+	paramLambdaLogScale1      = 0x5B61A599
+	paramLambdaLogScale2      = 0xB9BBAE03
+	paramTrellisDeltaDCWeight = 0x13775453
+	paramCompressProfile      = 0xE9918625
+	paramTrellisFreqSplit     = 0x6FAFF127
+	paramTrellisLoops         = 0xB63EBF39
+	paramBaseQuantTblIdx      = 0x44492AB1
+	paramDCScanOptMode        = 0x0BE7AD3C
+)
+
+var (
+	baseTablesOnce sync.Once
+	baseTables     [][2][64]uint16
+	stdHuffOnce    sync.Once
+	stdHuff        [4]C.JHUFF_TBL // DC 0, DC 1, AC 0, AC 1
+)
+
 var encoderPool = &sync.Pool{}
 
+// Whether the library has mozjpeg extensions, which are called only if it does.
+var hasCParams = C.haveCParams() != 0
+
 type encoder struct {
 	cInfo    C.struct_jpeg_compress_struct // must be first
 	writeBuf [bufferSize]byte
@@ -61,7 +106,8 @@ type encoder struct {
 type encoderTransient struct {
 	NBWritten int
 	*Options
-	io.Writer // The underlying data stream
+	io.Writer        // The underlying data stream, nil when appending to out
+	out       []byte // Output so far, when appending to memory
 }
 
 func (w *encoder) cleanup(abort bool) {
@@ -76,16 +122,45 @@ func (w *encoder) cleanup(abort bool) {
 	if abort {
 		C.jpeg_abort_compress(&w.cInfo)
 	}
+	w.resetHuffTables()
 	encoderPool.Put(w)
 }
 
+// Optimized coding overwrites Huffman tables in place. jpeg_set_defaults doesn't undo
+// it in libjpeg-turbo, whose add_huff_table (jstdhuff.c) returns early for tables
+// already allocated, so put the standard ones back.
+func (w *encoder) resetHuffTables() {
+	ci := &w.cInfo
+	for i, t := range []*C.JHUFF_TBL{ci.dc_huff_tbl_ptrs[0], ci.dc_huff_tbl_ptrs[1], ci.ac_huff_tbl_ptrs[0], ci.ac_huff_tbl_ptrs[1]} {
+		if t != nil {
+			*t = stdHuff[i]
+		}
+	}
+}
+
 func (w *encoder) setBuffer(n int) {
 	w.NBWritten += n
 	w.cInfo.dest.free_in_buffer = bufferSize
 	w.cInfo.dest.next_output_byte = (*C.uchar)(unsafe.Pointer(&w.writeBuf[0]))
 }
 
-func Encode(o io.Writer, img image.Image, opt *Options) error {
+// Let libjpeg write straight into spare capacity of out, after n more bytes were
+// written there. Grows out when it is full.
+func (w *encoder) setAppend(n int) {
+	w.NBWritten += n
+	w.out = w.out[:len(w.out)+n]
+	if len(w.out) == cap(w.out) {
+		grown := make([]byte, len(w.out), 2*cap(w.out)+4096)
+		copy(grown, w.out)
+		w.out = grown
+	}
+	spare := w.out[len(w.out):cap(w.out)]
+	w.cInfo.dest.free_in_buffer = C.size_t(len(spare))
+	w.cInfo.dest.next_output_byte = (*C.uchar)(unsafe.Pointer(&spare[:1][0]))
+}
+
+// Get encoder writing to o.
+func getEncoder(o io.Writer) *encoder {
 	// Alloc from pool
 	w, ok := encoderPool.Get().(*encoder)
 	if !ok {
@@ -95,6 +170,12 @@ func Encode(o io.Writer, img image.Image, opt *Options) error {
 		ci.err = &cb.err
 		C.jpeg_CreateCompress(&w.cInfo, C.JPEG_LIB_VERSION, C.sizeof_struct_jpeg_compress_struct)
 		ci.dest = &cb.dst
+		stdHuffOnce.Do(func() {
+			// Fresh encoder has the standard tables after defaults.
+			ci.in_color_space, ci.input_components = C.JCS_GRAYSCALE, 1
+			C.jpeg_set_defaults(&w.cInfo)
+			stdHuff = [4]C.JHUFF_TBL{*ci.dc_huff_tbl_ptrs[0], *ci.dc_huff_tbl_ptrs[1], *ci.ac_huff_tbl_ptrs[0], *ci.ac_huff_tbl_ptrs[1]}
+		})
 		runtime.SetFinalizer(w, func(r *encoder) {
 			C.free(unsafe.Pointer(r.cInfo.err))
 			C.jpeg_destroy_compress(&r.cInfo)
@@ -102,97 +183,272 @@ func Encode(o io.Writer, img image.Image, opt *Options) error {
 	}
 	w.setBuffer(0)
 	w.Writer = o
+	return w
+}
+
+// Encode an image with given options. Any image.Image is accepted, though
+// only YCbCr, Gray, CMYK, and opaque RGBA/NRGBA are passed to libjpeg as-is.
+// Everything else gets converted to 8-bit RGB or Gray row by row, with
+// transparency resolved according to Options.Alpha.
+func Encode(o io.Writer, img image.Image, opt *Options) error {
+	_, err := encode(o, nil, img, opt)
+	return err
+}
+
+// Encode an image like Encode does, appending the file to dst. libjpeg writes into
+// dst directly, growing it as needed. On error, dst is returned as it was.
+func AppendEncode(dst []byte, img image.Image, opt *Options) ([]byte, error) {
+	return encode(nil, dst, img, opt)
+}
 
+// Encode into o, or append to dst if o is nil.
+func encode(o io.Writer, dst []byte, img image.Image, opt *Options) (out []byte, err error) {
+	out = dst
 	if opt == nil {
 		opt = &DefaultEncoderOptions
 	}
+	if opt.Alpha == AlphaError && !isOpaque(img) {
+		return dst, ErrTransparent
+	}
+	if opt.Thumbnail != (image.Point{}) {
+		markers, err := addThumbnail(img, opt)
+		if err != nil {
+			return dst, err
+		}
+		o := *opt
+		o.Markers, o.Thumbnail = markers, image.Point{}
+		opt = &o
+	}
+
+	w := getEncoder(o)
+	defer errHandle(&err, w)
+	w.Options = opt
+	if o == nil {
+		w.out = dst
+		w.setAppend(0)
+	}
+
+	// Color images which are effectively gray can be saved as such
+	if fuzz, ok := opt.grayFuzz(); ok && isOpaque(img) {
+		if gr := util.ToGray(img, fuzz); gr != nil {
+			img = gr
+		}
+	}
 
 	// Setup image
 	ci := &w.cInfo
-	ci.image_width = C.JDIMENSION(img.Bounds().Dx())
-	ci.image_height = C.JDIMENSION(img.Bounds().Dy())
-
-	cm := img.ColorModel()
-	if cm == color.YCbCrModel {
-		im := img.(*image.YCbCr)
-		ci.input_components = 3
-		ci.in_color_space = C.JCS_YCbCr
-		w.parseOptions(opt)
-		c := (*[3]C.jpeg_component_info)(unsafe.Pointer(ci.comp_info))
-		yv, yh := util.SSR2VHDiv(im.SubsampleRatio)
-		c[0].v_samp_factor, c[0].h_samp_factor = C.int(yv), C.int(yh)
-		c[1].v_samp_factor, c[1].h_samp_factor = 1, 1
-		c[2].v_samp_factor, c[2].h_samp_factor = 1, 1
-		ci.raw_data_in = C.TRUE
-		C.jpeg_start_compress(&w.cInfo, C.TRUE)
-		C.encodeYCbCr(&w.cInfo,
-			(*C.uchar)(unsafe.Pointer(&im.Y[0])),
-			(*C.uchar)(unsafe.Pointer(&im.Cb[0])),
-			(*C.uchar)(unsafe.Pointer(&im.Cr[0])),
-			C.int(im.YStride),
-			C.int(im.CStride))
-	} else {
-		switch cm {
-		case color.RGBAModel:
-		case color.NRGBAModel:
-			ci.input_components = 4
-			ci.in_color_space = C.JCS_EXT_RGBA
-		case color.GrayModel:
-			ci.input_components = 1
-			ci.in_color_space = C.JCS_GRAYSCALE
-		case color.CMYKModel:
-			ci.input_components = 4
-			ci.in_color_space = C.JCS_CMYK
-		}
-		w.parseOptions(opt)
-		if opt.Gamma != 0 {
-			ci.input_gamma = C.double(opt.Gamma)
-		}
-		ci.data_precision = 8
-		C.jpeg_start_compress(&w.cInfo, C.TRUE)
-		pix, stride := util.GetPixStride(img)
-		C.encodeScan(&w.cInfo, (*C.uchar)(&pix[0]), C.int(stride))
+	b := img.Bounds()
+	ci.image_width = C.JDIMENSION(b.Dx())
+	ci.image_height = C.JDIMENSION(b.Dy())
+	if ci.image_width == 0 || ci.image_height == 0 {
+		throw("empty image %v", b)
+	}
+
+	// Planes are written as they are, unless stored in another color space.
+	raw := opt.JPEGColorSpace == ColorSpaceDefault || opt.JPEGColorSpace == ColorSpaceYCbCr
+	switch im := img.(type) {
+	case *image.YCbCr:
+		if raw {
+			w.encodeYCbCr(im)
+		} else {
+			w.encodeRows(img)
+		}
+	case *image.NYCbCrA:
+		// Alpha is all 0xff or we don't care, so it's just a YCbCr
+		if raw && (opt.Alpha == AlphaIgnore || im.Opaque()) {
+			w.encodeYCbCr(&im.YCbCr)
+		} else {
+			w.encodeRows(img)
+		}
+	case *image.Gray:
+		w.encodePix(im.Pix, im.PixOffset(b.Min.X, b.Min.Y), im.Stride, 1, C.JCS_GRAYSCALE)
+	case *image.CMYK:
+		w.encodePix(im.Pix, im.PixOffset(b.Min.X, b.Min.Y), im.Stride, 4, C.JCS_CMYK)
+	case *image.RGBA:
+		// libjpeg ignores the 4th byte, but premultiplied color is correct only if opaque.
+		if im.Opaque() {
+			w.encodePix(im.Pix, im.PixOffset(b.Min.X, b.Min.Y), im.Stride, 4, C.JCS_EXT_RGBA)
+		} else {
+			w.encodeRows(img)
+		}
+	case *image.NRGBA:
+		if opt.Alpha == AlphaIgnore || im.Opaque() {
+			w.encodePix(im.Pix, im.PixOffset(b.Min.X, b.Min.Y), im.Stride, 4, C.JCS_EXT_RGBA)
+		} else {
+			w.encodeRows(img)
+		}
+	default:
+		w.encodeRows(img)
 	}
 
 	C.jpeg_finish_compress(&w.cInfo)
+	if opt.Grayscale != nil {
+		*opt.Grayscale = ci.jpeg_color_space == C.JCS_GRAYSCALE
+	}
+	if o == nil {
+		out = w.out
+	}
 	w.cleanup(false)
-	return nil
+	return out, nil
 }
 
-func (w *encoder) parseOptions(opt *Options) {
+// Encode planar YCbCr directly, without any color conversion.
+func (w *encoder) encodeYCbCr(im *image.YCbCr) {
+	ci := &w.cInfo
+	ci.input_components = 3
+	ci.in_color_space = C.JCS_YCbCr
+	w.parseOptions(w.Options)
+	w.setSubsampling(im.SubsampleRatio)
+	c := (*[3]C.jpeg_component_info)(unsafe.Pointer(ci.comp_info))
+	yv, yh := util.SSR2VHDiv(im.SubsampleRatio)
+	ci.raw_data_in = C.TRUE
+	C.jpeg_start_compress(&w.cInfo, C.TRUE)
+	w.writeMarkers()
+
+	// Chroma samples covering the (possibly sub-)image.
+	b := im.Rect
+	cw, ch := (b.Dx()+yh-1)/yh, (b.Dy()+yv-1)/yv
+	icb, icr, ics := util.AlignedChroma(im)
+	y, ys := padPlane(im.Y[im.YOffset(b.Min.X, b.Min.Y):], im.YStride, b.Dx(), b.Dy(), &c[0])
+	cb, cs := padPlane(icb, ics, cw, ch, &c[1])
+	crp, _ := padPlane(icr, ics, cw, ch, &c[2])
+	C.encodeYCbCr(&w.cInfo,
+		(*C.uchar)(unsafe.Pointer(&y[0])),
+		(*C.uchar)(unsafe.Pointer(&cb[0])),
+		(*C.uchar)(unsafe.Pointer(&crp[0])),
+		C.int(ys),
+		C.int(cs))
+}
+
+// Raw encoder reads whole blocks, past the image edges. If the plane doesn't
+// extend that far, copy it into a bigger one with edge pixels replicated.
+func padPlane(pix []byte, stride, w, h int, comp *C.jpeg_component_info) ([]byte, int) {
+	cols := int(comp.width_in_blocks) * dctSize
+	rows := int(comp.height_in_blocks) * dctSize
+	if (rows-1)*stride+cols <= len(pix) {
+		return pix, stride
+	}
+	if w > cols {
+		w = cols
+	}
+	if h > rows {
+		h = rows
+	}
+	nstride := alignto(cols, 32)
+	buf := alignedBuf(nstride * rows)
+	for y := 0; y < rows; y++ {
+		row := buf[y*nstride:][:cols]
+		if y < h {
+			copy(row[:w], pix[y*stride:])
+		} else {
+			copy(row, buf[(h-1)*nstride:][:cols])
+			continue
+		}
+		for x := w; x < cols; x++ {
+			row[x] = row[w-1]
+		}
+	}
+	return buf, nstride
+}
+
+// Set up for scanline encoding of 8-bit samples in given colorspace.
+func (w *encoder) startScan(ncomp int, cs C.J_COLOR_SPACE) {
 	ci := &w.cInfo
-	ext := opt.Ext
-	if ext == nil {
-		ext = ExtOptions{}
+	ci.input_components = C.int(ncomp)
+	ci.in_color_space = cs
+	w.parseOptions(w.Options)
+	if w.Gamma != 0 {
+		ci.input_gamma = C.double(w.Gamma)
 	}
+	if w.UseSubsampling && ci.jpeg_color_space == C.JCS_YCbCr {
+		w.setSubsampling(w.Subsampling)
+	}
+	ci.data_precision = 8
+	C.jpeg_start_compress(&w.cInfo, C.TRUE)
+	w.writeMarkers()
+}
 
-	// Set profile first
-	if prof, ok := ext[OptCompressProfile]; ok {
-		w.setParam(OptCompressProfile, prof)
+// Write extra markers, these go right after JFIF/Adobe headers libjpeg writes.
+func (w *encoder) writeMarkers() {
+	for _, m := range w.Markers {
+		if (m.Code < MarkerAPP0 || m.Code > MarkerAPP15) && m.Code != MarkerCOM {
+			throw("can't write marker 0x%02x", m.Code)
+		}
+		if len(m.Data) > MaxMarkerLen {
+			throw("marker 0x%02x too long, %d bytes", m.Code, len(m.Data))
+		}
+		var data *C.JOCTET
+		if len(m.Data) > 0 {
+			data = (*C.JOCTET)(&m.Data[0])
+		}
+		C.jpeg_write_marker(&w.cInfo, C.int(m.Code), data, C.uint(len(m.Data)))
+	}
+}
+
+// Set sampling factors of luma, so that chroma ends up subsampled by given ratio.
+func (w *encoder) setSubsampling(ssr image.YCbCrSubsampleRatio) {
+	if ssr < image.YCbCrSubsampleRatio444 || ssr > image.YCbCrSubsampleRatio410 {
+		throw("unknown subsampling ratio %v", ssr)
 	}
+	c := (*[3]C.jpeg_component_info)(unsafe.Pointer(w.cInfo.comp_info))
+	v, h := util.SSR2VHDiv(ssr)
+	c[0].v_samp_factor, c[0].h_samp_factor = C.int(v), C.int(h)
+	c[1].v_samp_factor, c[1].h_samp_factor = 1, 1
+	c[2].v_samp_factor, c[2].h_samp_factor = 1, 1
+}
+
+// Encode interleaved pixel buffer libjpeg understands natively.
+// Starts at offset of the top left pixel, as the image can be a sub-image.
+func (w *encoder) encodePix(pix []byte, off, stride, ncomp int, cs C.J_COLOR_SPACE) {
+	w.startScan(ncomp, cs)
+	C.encodeScan(&w.cInfo, (*C.uchar)(&pix[off]), C.int(stride))
+}
+
+// Encode anything else, converting one row at a time.
+func (w *encoder) encodeRows(img image.Image) {
+	conv, ncomp := newRowConverter(img, newBlender(w.Alpha, w.Background))
+	cs := C.J_COLOR_SPACE(C.JCS_RGB)
+	if ncomp == 1 {
+		cs = C.JCS_GRAYSCALE
+	}
+	w.startScan(ncomp, cs)
+	b := img.Bounds()
+	row := make([]byte, b.Dx()*ncomp)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		conv(row, y)
+		C.encodeRow(&w.cInfo, (*C.uchar)(&row[0]))
+	}
+}
+
+func (w *encoder) parseOptions(opt *Options) {
+	ci := &w.cInfo
+
+	// Set profile first
+	w.setProfile(opt.Ext.Profile)
 
 	// Apply defaults from profile
 	C.jpeg_set_defaults(&w.cInfo)
+	w.setColorSpace(opt.JPEGColorSpace)
 
 	// Not progressive, so disable scans
 	if opt.NoProgressive {
-		w.setParam(OptScans, false)
+		w.setBool(paramOptimizeScans, false)
 	}
 
-	// Now apply GUID params
-	for k, v := range ext {
-		w.setParam(k, v)
-	}
+	// Now apply mozjpeg params
+	w.setExt(&opt.Ext)
 
 	// If 0, defaults to 75
 	if opt.Quality > 0 {
 		C.jpeg_set_quality(&w.cInfo, C.int(opt.Quality), bool2c(opt.ForceBaseline))
 	}
 
+	w.setDensity(opt.Density)
+
 	// The rest of the options are final override
 	ci.dct_method = C.J_DCT_METHOD(opt.DCTMethod)
 	ci.smoothing_factor = C.int(opt.SmoothingFactor)
-	ci.optimize_coding = bool2c(!opt.FastHufftab)
+	ci.optimize_coding = bool2c(!opt.FastHufftab && !opt.ArithmeticCoding) // No Huffman tables with arithmetic coding
 	ci.do_fancy_downsampling = bool2c(!opt.NoFancyDownsampling)
 	ci.arith_code = bool2c(opt.ArithmeticCoding)
 
@@ -211,22 +467,170 @@ func (w *encoder) parseOptions(opt *Options) {
 	// TODO: multi-scan scripts
 }
 
-func (w *encoder) setParam(n uint64, v interface{}) {
-	g := uint32(n)
-	switch n >> 32 {
-	case 0:
-		b, ok := v.(byte)
-		if !ok && v.(bool) {
-			b = 1
+// Store the image as cs, instead of what libjpeg picks for the input.
+func (w *encoder) setColorSpace(cs ColorSpace) {
+	if cs == ColorSpaceDefault {
+		return
+	}
+	in := ColorSpaceRGB
+	switch w.cInfo.in_color_space {
+	case C.JCS_GRAYSCALE:
+		in = ColorSpaceGray
+	case C.JCS_CMYK:
+		in = ColorSpaceCMYK
+	}
+	if !cs.storableFrom(in) {
+		throw("can't store %v input as %v", in, cs)
+	}
+	C.jpeg_set_colorspace(&w.cInfo, [...]C.J_COLOR_SPACE{
+		ColorSpaceYCbCr: C.JCS_YCbCr,
+		ColorSpaceRGB:   C.JCS_RGB,
+		ColorSpaceGray:  C.JCS_GRAYSCALE,
+		ColorSpaceCMYK:  C.JCS_CMYK,
+		ColorSpaceYCCK:  C.JCS_YCCK,
+	}[cs])
+}
+
+// Base quantization tables [luma, chroma] for each ExtOptions.BaseQuantTable, as known
+// to the library. Plain libjpeg ignores the index, and has only the IJG ones. If the
+// library fails to tell, Annex K ones are assumed.
+func baseQuantTables() [][2][64]uint16 {
+	baseTablesOnce.Do(func() {
+		var err error
+		if baseTables, err = libraryQuantTables(); err != nil {
+			baseTables = [][2][64]uint16{stdQuant}
 		}
-		C.jpeg_c_set_bool_param(&w.cInfo, C.J_BOOLEAN_PARAM(g), C.uchar(b))
-	case 1:
-		f, ok := v.(float32)
-		if !ok {
-			f = float32(v.(float64))
+	})
+	return baseTables
+}
+
+func libraryQuantTables() (tables [][2][64]uint16, err error) {
+	w := getEncoder(nil)
+	defer errHandle(&err, w)
+	for i := 0; i < 9; i++ {
+		w.setInt(paramBaseQuantTblIdx, i)
+		// Scale of quality 50 is 100%
+		C.jpeg_set_quality(&w.cInfo, 50, 0)
+		var t [2][64]uint16
+		for j := range t {
+			q := w.cInfo.quant_tbl_ptrs[j]
+			for k := range t[j] {
+				t[j][k] = uint16(q.quantval[k])
+			}
 		}
-		C.jpeg_c_set_float_param(&w.cInfo, C.J_FLOAT_PARAM(g), C.float(f))
-	case 2:
-		C.jpeg_c_set_int_param(&w.cInfo, C.J_INT_PARAM(g), C.int(v.(int)))
+		tables = append(tables, t)
+	}
+	// Back to the default index, so that it doesn't stick to the pooled encoder.
+	w.setInt(paramBaseQuantTblIdx, 0)
+	w.cleanup(false)
+	return
+}
+
+// Set JFIF density, unless it's unset.
+func (w *encoder) setDensity(d Density) {
+	if d.X <= 0 || d.Y <= 0 {
+		return
+	}
+	if d.Unit < DensityNone || d.Unit > DensityCm || d.X > 0xffff || d.Y > 0xffff {
+		throw("invalid density %+v", d)
+	}
+	ci := &w.cInfo
+	if ci.write_JFIF_header == 0 {
+		throw("density needs JFIF header, not written for color space %d", int(ci.jpeg_color_space))
+	}
+	ci.density_unit = C.UINT8(d.Unit)
+	ci.X_density = C.UINT16(d.X)
+	ci.Y_density = C.UINT16(d.Y)
+}
+
+// Set mozjpeg compression profile, if any.
+func (w *encoder) setProfile(p CompressProfile) {
+	switch p {
+	case ProfileDefault:
+	case ProfileMaxCompression, ProfileFastest:
+		needCParams()
+		w.setInt(paramCompressProfile, int(p))
+	default:
+		throw("unknown compression profile %#x", uint32(p))
+	}
+}
+
+// Apply mozjpeg settings other than profile, checking their values.
+func (w *encoder) setExt(ext *ExtOptions) {
+	for _, p := range []struct {
+		id uint32
+		v  *bool
+	}{
+		{paramOptimizeScans, ext.OptimizeScans},
+		{paramTrellis, ext.Trellis},
+		{paramTrellisDC, ext.TrellisDC},
+		{paramOptimizeEOB, ext.OptimizeEOB},
+		{paramLambdaWeight, ext.LambdaWeight},
+		{paramTrellisUseScans, ext.TrellisUseScans},
+		{paramTrellisQuant, ext.TrellisQuant},
+		{paramDeringing, ext.Deringing},
+	} {
+		if p.v != nil {
+			needCParams()
+			w.setBool(p.id, *p.v)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		id   uint32
+		v    *float64
+	}{
+		{"LambdaLogScale1", paramLambdaLogScale1, ext.LambdaLogScale1},
+		{"LambdaLogScale2", paramLambdaLogScale2, ext.LambdaLogScale2},
+		{"TrellisDeltaDCWeight", paramTrellisDeltaDCWeight, ext.TrellisDeltaDCWeight},
+	} {
+		if p.v == nil {
+			continue
+		}
+		if math.IsNaN(*p.v) || math.IsInf(*p.v, 0) {
+			throw("invalid %s %v", p.name, *p.v)
+		}
+		needCParams()
+		C.jpeg_c_set_float_param(&w.cInfo, C.J_FLOAT_PARAM(p.id), C.float(*p.v))
+	}
+	for _, p := range []struct {
+		name     string
+		id       uint32
+		v        *int
+		min, max int
+	}{
+		{"TrellisFreqSplit", paramTrellisFreqSplit, ext.TrellisFreqSplit, 0, 63},
+		{"TrellisLoops", paramTrellisLoops, ext.TrellisLoops, 1, math.MaxInt32},
+		{"BaseQuantTable", paramBaseQuantTblIdx, ext.BaseQuantTable, 0, 8},
+		{"DCScanMode", paramDCScanOptMode, ext.DCScanMode, 0, 2},
+	} {
+		if p.v == nil {
+			continue
+		}
+		if *p.v < p.min || *p.v > p.max {
+			throw("%s %d out of range %d-%d", p.name, *p.v, p.min, p.max)
+		}
+		needCParams()
+		w.setInt(p.id, *p.v)
+	}
+}
+
+// ExtOptions are an error without mozjpeg, rather than silently ignored.
+func needCParams() {
+	if !hasCParams {
+		throw("ExtOptions need mozjpeg, the linked library has no jpeg_c_set_*_param")
+	}
+}
+
+// Set mozjpeg parameter, if the library has them.
+func (w *encoder) setBool(id uint32, v bool) {
+	if hasCParams {
+		C.jpeg_c_set_bool_param(&w.cInfo, C.J_BOOLEAN_PARAM(id), bool2c(v))
+	}
+}
+
+func (w *encoder) setInt(id uint32, v int) {
+	if hasCParams {
+		C.jpeg_c_set_int_param(&w.cInfo, C.J_INT_PARAM(id), C.int(v))
 	}
 }
@@ -0,0 +1,136 @@
+package mjpeg
+
+import (
+	"bytes"
+	"github.com/ezdiy/image/jpeg"
+	"image"
+	"io"
+	"testing"
+	"time"
+)
+
+// Frames as webcams send them, without DHT, and one with optimized tables.
+func frames(t *testing.T) (files [][]byte, want []image.Image) {
+	for i := 0; i < 4; i++ {
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+		for p := 0; p < len(img.Pix); p += 4 {
+			img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = byte(p*i), byte(p>>4), byte(i*60), 255
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{NoProgressive: true, FastHufftab: i != 1}); err != nil {
+			t.Fatal(err)
+		}
+		file := buf.Bytes()
+		ref, err := jpeg.DecodeBytes(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 1 {
+			info, err := jpeg.Inspect(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out []byte
+			prev := 0
+			for _, m := range info.Markers {
+				if m.Code == 0xc4 {
+					out = append(out, file[prev:m.Offset]...)
+					prev = m.Offset + m.Length
+				}
+			}
+			file = append(out, file[prev:]...)
+		}
+		files = append(files, file)
+		want = append(want, ref)
+	}
+	return
+}
+
+func TestInsertDHT(t *testing.T) {
+	files, want := frames(t)
+	for i, file := range files {
+		got, err := jpeg.DecodeBytes(insertDHT(nil, file), nil)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(got.(*image.YCbCr).Y, want[i].(*image.YCbCr).Y) {
+			t.Fatalf("frame %d differs", i)
+		}
+	}
+	if got := insertDHT(nil, files[1]); &got[0] != &files[1][0] {
+		t.Fatal("tables inserted into frame which has them")
+	}
+}
+
+func TestStream(t *testing.T) {
+	files, want := frames(t)
+	base := time.Unix(1500000000, 250000000)
+	for _, multi := range []bool{false, true} {
+		var buf bytes.Buffer
+		var w *Writer
+		var r *Reader
+		if multi {
+			w = NewMultipartWriter(&buf)
+		} else {
+			w = NewWriter(&buf)
+		}
+		for i, file := range files {
+			if err := w.WriteFrame(file, base.Add(time.Duration(i)*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if multi {
+			r = NewMultipartReader(&buf, w.boundary)
+		} else {
+			buf.WriteString("junk")
+			r = NewReader(&buf)
+		}
+
+		var prev image.Image
+		for i := range files {
+			f, err := r.Next()
+			if err != nil {
+				t.Fatal(multi, i, err)
+			}
+			y := f.Image.(*image.YCbCr)
+			if !bytes.Equal(y.Y, want[i].(*image.YCbCr).Y) || !bytes.Equal(y.Cr, want[i].(*image.YCbCr).Cr) {
+				t.Fatalf("%v frame %d differs", multi, i)
+			}
+			if prev != nil && prev != f.Image {
+				t.Fatalf("%v frame %d not decoded into the previous image", multi, i)
+			}
+			prev = f.Image
+			if multi && !f.Time.Equal(base.Add(time.Duration(i)*time.Second)) {
+				t.Fatalf("frame %d time %v", i, f.Time)
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("%v expected EOF, got %v", multi, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for i := 0; i < 3; i++ {
+		img.Pix[i] = 255
+		if err := w.Encode(img, time.Time{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-100]))
+	r.NoDecode = true
+	for i := 0; i < 2; i++ {
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
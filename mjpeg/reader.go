@@ -0,0 +1,230 @@
+package mjpeg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/ezdiy/image/jpeg"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrFormat = errors.New("mjpeg: malformed frame")
+	soi       = []byte{0xff, 0xd8}
+)
+
+// Frame of Motion JPEG stream.
+type Frame struct {
+	Data   []byte               // JPEG file, with standard Huffman tables inserted if it had none
+	Image  image.Image          // Decoded Data, unless Reader.NoDecode
+	Time   time.Time            // X-Timestamp of the part if it has one, time of arrival otherwise
+	Header textproto.MIMEHeader // Of the multipart part, nil for raw streams
+}
+
+// Reads frames of Motion JPEG stream. Data and Image of a frame are reused for the next
+// one, as long as the frame size and format stay, so copy them to keep them around.
+type Reader struct {
+	Options  *jpeg.DecoderOptions // For decoding frames
+	NoDecode bool                 // Read only Data of frames
+
+	br       *bufio.Reader
+	mr       *multipart.Reader
+	frame    Frame
+	raw, dht []byte // Buffers for Data
+	src      bytes.Reader
+}
+
+// Reader of JPEG files back to back.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{br: bufio.NewReader(r)}
+}
+
+// Reader of multipart stream, such as HTTP multipart/x-mixed-replace. Parts which
+// aren't JPEG files are skipped.
+func NewMultipartReader(r io.Reader, boundary string) *Reader {
+	return &Reader{mr: multipart.NewReader(r, boundary)}
+}
+
+// Reader of HTTP response body, multipart if Content-Type says so, raw otherwise.
+func NewResponseReader(resp *http.Response) (*Reader, error) {
+	ct := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "multipart/") {
+		return NewReader(resp.Body), nil
+	}
+	_, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, err
+	}
+	if params["boundary"] == "" {
+		return nil, errors.New("mjpeg: no multipart boundary")
+	}
+	return NewMultipartReader(resp.Body, params["boundary"]), nil
+}
+
+// Read the next frame. Returns io.EOF at the end of stream.
+func (r *Reader) Next() (*Frame, error) {
+	f := &r.frame
+	var data []byte
+	var err error
+	if r.mr != nil {
+		data, err = r.readPart()
+	} else {
+		data, err = r.readRaw()
+		f.Time = time.Now()
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Data = insertDHT(r.dht, data)
+	if len(f.Data) != len(data) {
+		r.dht = f.Data
+	}
+	if r.NoDecode {
+		return f, nil
+	}
+	if f.Image, err = r.decode(f.Data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Decode into the previous image if it fits.
+func (r *Reader) decode(data []byte) (image.Image, error) {
+	if img := r.frame.Image; img != nil {
+		r.src.Reset(data)
+		err := errors.New("not reusable")
+		switch dst := img.(type) {
+		case *image.YCbCr:
+			err = jpeg.DecodeYCbCrInto(dst, &r.src, r.Options)
+		case *image.Gray, *image.RGBA, *image.NRGBA, *image.CMYK:
+			err = jpeg.DecodeInto(dst.(draw.Image), &r.src, r.Options)
+		}
+		if err == nil {
+			return img, nil
+		}
+	}
+	return jpeg.DecodeBytes(data, r.Options)
+}
+
+// Read next JPEG part of multipart stream.
+func (r *Reader) readPart() ([]byte, error) {
+	for {
+		part, err := r.mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(r.raw[:0])
+		_, err = buf.ReadFrom(part)
+		r.raw = buf.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		i := bytes.Index(r.raw, soi)
+		if i < 0 {
+			continue
+		}
+		f := &r.frame
+		f.Header = part.Header
+		f.Time = time.Now()
+		if ts, err := strconv.ParseFloat(part.Header.Get("X-Timestamp"), 64); err == nil {
+			sec, frac := math.Modf(ts)
+			f.Time = time.Unix(int64(sec), int64(frac*1e9))
+		}
+		return r.raw[i:], nil
+	}
+}
+
+// Read next JPEG file of raw stream, up to EOI.
+func (r *Reader) readRaw() ([]byte, error) {
+	br := r.br
+	for prev := byte(0); ; {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if prev == 0xff && c == 0xd8 {
+			break
+		}
+		prev = c
+	}
+	buf := append(r.raw[:0], soi...)
+	defer func() { r.raw = buf }()
+	ff := false // 0xff of the next marker is in buf already
+	for {
+		c, err := br.ReadByte()
+		if !ff && err == nil {
+			if c != 0xff {
+				return nil, ErrFormat
+			}
+			buf = append(buf, 0xff)
+			c, err = br.ReadByte()
+		}
+		ff = false
+		for err == nil && c == 0xff {
+			c, err = br.ReadByte() // Fill bytes
+		}
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf = append(buf, c)
+		switch {
+		case c == 0xd9:
+			return buf, nil
+		case c == 0x01 || (c >= 0xd0 && c <= 0xd7):
+			continue
+		case c == 0 || c == 0xd8:
+			return nil, ErrFormat
+		}
+
+		var l [2]byte
+		if _, err := io.ReadFull(br, l[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint16(l[:]))
+		if n < 2 {
+			return nil, ErrFormat
+		}
+		buf = append(buf, l[:]...)
+		start := len(buf)
+		buf = append(buf, make([]byte, n-2)...)
+		if _, err := io.ReadFull(br, buf[start:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if c != 0xda {
+			continue
+		}
+
+		// Entropy coded data, up to a marker other than RSTn.
+		for {
+			chunk, err := br.ReadSlice(0xff)
+			buf = append(buf, chunk...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			next, err := br.Peek(1)
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if next[0] != 0 && (next[0] < 0xd0 || next[0] > 0xd7) {
+				ff = true
+				break
+			}
+			buf = append(buf, next[0])
+			br.ReadByte()
+		}
+	}
+}
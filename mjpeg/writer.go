@@ -0,0 +1,82 @@
+package mjpeg
+
+import (
+	"fmt"
+	"github.com/ezdiy/image/jpeg"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// Writes Motion JPEG stream, as JPEG files back to back, or multipart with each file
+// in a part of its own. Frames are flushed as they're written when the underlying
+// writer is a http.Flusher.
+type Writer struct {
+	w        io.Writer
+	boundary string // Empty for raw streams
+	buf      []byte // Reused by Encode
+}
+
+// Writer of JPEG files back to back.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Writer of multipart/x-mixed-replace stream, with random boundary.
+func NewMultipartWriter(w io.Writer) *Writer {
+	return &Writer{w: w, boundary: multipart.NewWriter(ioutil.Discard).Boundary()}
+}
+
+// Content-Type to send the stream with.
+func (w *Writer) ContentType() string {
+	if w.boundary == "" {
+		return "video/x-motion-jpeg"
+	}
+	return "multipart/x-mixed-replace; boundary=" + w.boundary
+}
+
+// Write JPEG file as the next frame. Non-zero t is sent as X-Timestamp header of
+// multipart streams.
+func (w *Writer) WriteFrame(jpg []byte, t time.Time) (err error) {
+	if w.boundary != "" {
+		hdr := fmt.Sprintf("--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n", w.boundary, len(jpg))
+		if !t.IsZero() {
+			hdr += fmt.Sprintf("X-Timestamp: %d.%06d\r\n", t.Unix(), t.Nanosecond()/1000)
+		}
+		if _, err = io.WriteString(w.w, hdr+"\r\n"); err != nil {
+			return
+		}
+	}
+	if _, err = w.w.Write(jpg); err != nil {
+		return
+	}
+	if w.boundary != "" {
+		if _, err = io.WriteString(w.w, "\r\n"); err != nil {
+			return
+		}
+	}
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return
+}
+
+// Encode img as the next frame, see WriteFrame.
+func (w *Writer) Encode(img image.Image, t time.Time, opt *jpeg.Options) (err error) {
+	if w.buf, err = jpeg.AppendEncode(w.buf[:0], img, opt); err != nil {
+		return
+	}
+	return w.WriteFrame(w.buf, t)
+}
+
+// Write the closing boundary of multipart stream. The underlying writer isn't closed.
+func (w *Writer) Close() error {
+	if w.boundary == "" {
+		return nil
+	}
+	_, err := io.WriteString(w.w, "--"+w.boundary+"--\r\n")
+	return err
+}
@@ -0,0 +1,255 @@
+// Package mpf reads and writes the CIPA Multi-Picture Format index, which ties several
+// JPEG streams concatenated in one file together: stereo pairs, depth maps, large
+// previews or HDR gain maps.
+//
+// The index lives in APP2 segment of the first (primary) image, and points to other
+// images at offsets past the primary EOI.
+package mpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// APP2 header of MPF segment.
+var Header = []byte("MPF\x00")
+
+var (
+	ErrNotFound = errors.New("mpf: no MPF index")
+	ErrFormat   = errors.New("mpf: malformed index")
+)
+
+// Type of image, lower 24 bits of the entry attribute.
+type Type uint32
+
+const (
+	Undefined     Type = 0x000000 // Also used for gain maps and depth maps
+	LargeThumbVGA Type = 0x010001
+	LargeThumbHD  Type = 0x010002
+	Panorama      Type = 0x020001
+	Disparity     Type = 0x020002 // Stereo pair
+	MultiAngle    Type = 0x020003
+	Primary       Type = 0x030000 // Baseline MP primary image
+)
+
+// Flags of entry attribute.
+type Flags uint32
+
+const (
+	DependentParent Flags = 1 << 31
+	DependentChild  Flags = 1 << 30
+	Representative  Flags = 1 << 29
+)
+
+// Entry of the index, describing one image.
+type Entry struct {
+	Type
+	Flags
+	Size      uint32    // Length of the JPEG stream
+	Offset    uint32    // Relative to the MPF header of the primary image, 0 for the primary
+	Dependent [2]uint16 // Entry numbers (1-based) of dependent images, 0 if none
+}
+
+// Index of images in a file.
+type Index struct {
+	Order   binary.ByteOrder
+	Entries []Entry
+}
+
+const (
+	tagVersion   = 0xb000
+	tagNumImages = 0xb001
+	tagEntries   = 0xb002
+	entrySize    = 16
+	typeLong     = 4
+	typeUndef    = 7
+)
+
+// Parse APP2 payload. The payload may, or may not, start with Header.
+func Parse(b []byte) (*Index, error) {
+	b = bytes.TrimPrefix(b, Header)
+	if len(b) < 8 {
+		return nil, ErrFormat
+	}
+	ix := &Index{}
+	switch string(b[:4]) {
+	case "II*\x00":
+		ix.Order = binary.LittleEndian
+	case "MM\x00*":
+		ix.Order = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+	o := ix.Order
+	off := uint64(o.Uint32(b[4:]))
+	if off+2 > uint64(len(b)) {
+		return nil, ErrFormat
+	}
+	n := int(o.Uint16(b[off:]))
+	pos := int(off) + 2
+	if pos+n*12 > len(b) {
+		return nil, ErrFormat
+	}
+	var num, eoff, elen uint32
+	for i := 0; i < n; i++ {
+		ent := b[pos+i*12:][:12]
+		switch o.Uint16(ent) {
+		case tagNumImages:
+			num = o.Uint32(ent[8:])
+		case tagEntries:
+			elen, eoff = o.Uint32(ent[4:]), o.Uint32(ent[8:])
+		}
+	}
+	// Primary image at least.
+	if num == 0 || uint64(num)*entrySize != uint64(elen) || uint64(eoff)+uint64(elen) > uint64(len(b)) {
+		return nil, ErrFormat
+	}
+	for e := b[eoff:][:elen]; len(e) > 0; e = e[entrySize:] {
+		attr := o.Uint32(e)
+		ix.Entries = append(ix.Entries, Entry{
+			Type:      Type(attr & 0xffffff),
+			Flags:     Flags(attr &^ 0xffffff),
+			Size:      o.Uint32(e[4:]),
+			Offset:    o.Uint32(e[8:]),
+			Dependent: [2]uint16{o.Uint16(e[12:]), o.Uint16(e[14:])},
+		})
+	}
+	return ix, nil
+}
+
+// Serialize into APP2 payload, including the Header.
+func (ix *Index) Marshal() []byte {
+	o := ix.Order
+	if o == nil {
+		o = binary.BigEndian
+	}
+	const ifdLen = 2 + 3*12 + 4
+	n := len(ix.Entries)
+	b := make([]byte, 8+ifdLen+n*entrySize)
+	if o.Uint16([]byte{1, 0}) == 1 {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	o.PutUint16(b[2:], 42)
+	o.PutUint32(b[4:], 8)
+	ifd := b[8:]
+	o.PutUint16(ifd, 3)
+	tag := func(i int, id, typ uint16, count uint32) []byte {
+		ent := ifd[2+i*12:]
+		o.PutUint16(ent, id)
+		o.PutUint16(ent[2:], typ)
+		o.PutUint32(ent[4:], count)
+		return ent[8:12]
+	}
+	copy(tag(0, tagVersion, typeUndef, 4), "0100")
+	o.PutUint32(tag(1, tagNumImages, typeLong, 1), uint32(n))
+	o.PutUint32(tag(2, tagEntries, typeUndef, uint32(n*entrySize)), 8+ifdLen)
+	for i, e := range ix.Entries {
+		ent := b[8+ifdLen+i*entrySize:]
+		o.PutUint32(ent, uint32(e.Flags)|uint32(e.Type)&0xffffff)
+		o.PutUint32(ent[4:], e.Size)
+		o.PutUint32(ent[8:], e.Offset)
+		o.PutUint16(ent[12:], e.Dependent[0])
+		o.PutUint16(ent[14:], e.Dependent[1])
+	}
+	return append(append([]byte(nil), Header...), b...)
+}
+
+// Find APP2 segment with the index in the header of JPEG stream. Returns offset
+// of the segment marker, and the payload.
+func find(file []byte) (pos int, payload []byte, err error) {
+	if !bytes.HasPrefix(file, []byte{0xff, 0xd8}) {
+		return 0, nil, ErrNotFound
+	}
+	for pos = 2; pos+4 <= len(file) && file[pos] == 0xff; {
+		code := file[pos+1]
+		if code == 0xda || code == 0xd9 {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(file[pos+2:]))
+		if end > len(file) {
+			break
+		}
+		if code == 0xe2 && bytes.HasPrefix(file[pos+4:end], Header) {
+			return pos, file[pos+4 : end], nil
+		}
+		pos = end
+	}
+	return 0, nil, ErrNotFound
+}
+
+// Split a multi-picture file into JPEG streams of each image, in index order.
+func Split(file []byte) (*Index, [][]byte, error) {
+	pos, payload, err := find(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	ix, err := Parse(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := uint64(pos + 4 + len(Header))
+	var images [][]byte
+	for _, e := range ix.Entries {
+		start := base + uint64(e.Offset)
+		if e.Offset == 0 {
+			start = 0
+		}
+		if start+uint64(e.Size) > uint64(len(file)) {
+			return nil, nil, ErrFormat
+		}
+		images = append(images, file[start:start+uint64(e.Size)])
+	}
+	return ix, images, nil
+}
+
+// Write images as one multi-picture file. Size and Offset of index entries are filled
+// in, the rest is taken as-is. The index is inserted into the first image after
+// its leading APP0 and APP1 segments, replacing an old one.
+func Write(w io.Writer, ix *Index, images [][]byte) error {
+	if len(images) != len(ix.Entries) || len(images) == 0 {
+		return errors.New("mpf: need an index entry for each image")
+	}
+	primary := images[0]
+	if pos, payload, err := find(primary); err == nil {
+		primary = append(append([]byte(nil), primary[:pos]...), primary[pos+4+len(payload):]...)
+	}
+	if !bytes.HasPrefix(primary, []byte{0xff, 0xd8}) {
+		return errors.New("mpf: primary image is not JPEG")
+	}
+	pos := 2
+	for pos+4 <= len(primary) && primary[pos] == 0xff && (primary[pos+1] == 0xe0 || primary[pos+1] == 0xe1) {
+		pos += 2 + int(binary.BigEndian.Uint16(primary[pos+2:]))
+	}
+	if pos > len(primary) {
+		return ErrFormat
+	}
+
+	// Segment length doesn't depend on the offsets, so they can be computed up front.
+	seglen := len(ix.Marshal()) + 4
+	base := pos + 4 + len(Header)
+	end := len(primary) + seglen
+	for i := range ix.Entries {
+		e := &ix.Entries[i]
+		if i == 0 {
+			e.Size, e.Offset = uint32(end), 0
+			continue
+		}
+		e.Size, e.Offset = uint32(len(images[i])), uint32(end-base)
+		end += len(images[i])
+	}
+	payload := ix.Marshal()
+	seg := []byte{0xff, 0xe2, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	if len(payload)+2 > 0xffff {
+		return errors.New("mpf: too many images")
+	}
+	for _, b := range append([][]byte{primary[:pos], seg, payload, primary[pos:]}, images[1:]...) {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package mpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func fakeJPEG(app1 string, body string) []byte {
+	b := []byte{0xff, 0xd8}
+	if app1 != "" {
+		b = append(b, 0xff, 0xe1, 0, byte(len(app1)+2))
+		b = append(b, app1...)
+	}
+	b = append(b, 0xff, 0xdb, 0, 4, 0, 0)
+	b = append(b, body...)
+	return append(b, 0xff, 0xd9)
+}
+
+func TestSplit(t *testing.T) {
+	images := [][]byte{fakeJPEG("Exif\x00\x00", "primary"), fakeJPEG("", "depth"), fakeJPEG("", "right eye")}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		ix := &Index{Order: order, Entries: []Entry{
+			{Type: Primary, Flags: Representative | DependentParent, Dependent: [2]uint16{3, 0}},
+			{Type: Undefined},
+			{Type: Disparity, Flags: DependentChild},
+		}}
+		var buf bytes.Buffer
+		if err := Write(&buf, ix, images); err != nil {
+			t.Fatal(err)
+		}
+		file := buf.Bytes()
+		if !bytes.HasPrefix(file, images[0][:2+4+6]) {
+			t.Fatal("index not placed after APP1")
+		}
+		ix2, got, err := Split(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ix2, ix) {
+			t.Fatalf("index differs:\n%+v\n%+v", ix2, ix)
+		}
+		for i := 1; i < len(images); i++ {
+			if !bytes.Equal(got[i], images[i]) {
+				t.Fatalf("image %d differs", i)
+			}
+		}
+		if !bytes.HasSuffix(got[0], []byte("primary\xff\xd9")) {
+			t.Fatal("primary image truncated")
+		}
+
+		// Rewriting replaces the old index.
+		buf.Reset()
+		if err := Write(&buf, ix, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), file) {
+			t.Fatal("rewrite differs")
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	ix := &Index{Entries: []Entry{{Type: Primary}, {}}}
+	if err := Write(&buf, ix, [][]byte{fakeJPEG("", "a"), fakeJPEG("", "b")}); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	if _, _, err := Split(fakeJPEG("", "")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, _, err := Split(file[:len(file)-1]); err != ErrFormat {
+		t.Fatalf("expected ErrFormat, got %v", err)
+	}
+	empty := (&Index{}).Marshal()
+	if _, err := Parse(empty); err != ErrFormat {
+		t.Fatalf("empty index: expected ErrFormat, got %v", err)
+	}
+	seg := append([]byte{0xff, 0xd8, 0xff, 0xe2, byte((len(empty) + 2) >> 8), byte(len(empty) + 2)}, empty...)
+	if _, _, err := Split(append(seg, fakeJPEG("", "")[2:]...)); err != ErrFormat {
+		t.Fatalf("empty index: expected ErrFormat, got %v", err)
+	}
+	for i := 0; i < len(file); i++ {
+		c := append([]byte(nil), file...)
+		c[i] ^= 0xff
+		Split(c)
+		Split(file[:i])
+	}
+}
@@ -281,8 +281,8 @@ func (c *codec) encode(img image.Image, o *Options) (ok bool) {
 	if yimg, yuv := img.(*image.YCbCr); yuv {
 		v,h := util.SSR2VHDiv(yimg.SubsampleRatio)
 		for i := 1; i < 3;i ++ {
-			cpar[i].w /= C.uint(h)
-			cpar[i].h /= C.uint(v)
+			cpar[i].w = (cpar[i].w + C.uint(h-1)) / C.uint(h)
+			cpar[i].h = (cpar[i].h + C.uint(v-1)) / C.uint(v)
 			cpar[i].dx = C.uint(h)
 			cpar[i].dy = C.uint(v)
 		}
@@ -297,26 +297,32 @@ func (c *codec) encode(img image.Image, o *Options) (ok bool) {
 	c.image.x1 = C.uint(img.Bounds().Dx())
 	c.image.y1 = C.uint(img.Bounds().Dy())
 
+	// Sub-images start at the offset of their top left pixel.
+	b := img.Bounds()
 	switch cspc {
 	case C.OPJ_CLRSPC_GRAY:
 		ig := img.(*image.Gray)
-		c.comp(0).encodeComp(ig.Pix, 1, ig.Stride)
+		pix := ig.Pix[ig.PixOffset(b.Min.X, b.Min.Y):]
+		c.comp(0).encodeComp(pix, 1, ig.Stride)
 	case C.OPJ_CLRSPC_SRGB:
 		ig := img.(*image.RGBA)
-		c.comp(0).encodeComp(ig.Pix, 4, ig.Stride)
-		c.comp(1).encodeComp(ig.Pix[1:], 4, ig.Stride)
-		c.comp(2).encodeComp(ig.Pix[2:], 4, ig.Stride)
+		pix := ig.Pix[ig.PixOffset(b.Min.X, b.Min.Y):]
+		c.comp(0).encodeComp(pix, 4, ig.Stride)
+		c.comp(1).encodeComp(pix[1:], 4, ig.Stride)
+		c.comp(2).encodeComp(pix[2:], 4, ig.Stride)
 	case C.OPJ_CLRSPC_CMYK:
 		ig := img.(*image.CMYK)
-		c.comp(0).encodeComp(ig.Pix, 4, ig.Stride)
-		c.comp(1).encodeComp(ig.Pix[1:], 4, ig.Stride)
-		c.comp(2).encodeComp(ig.Pix[2:], 4, ig.Stride)
-		c.comp(2).encodeComp(ig.Pix[3:], 4, ig.Stride)
+		pix := ig.Pix[ig.PixOffset(b.Min.X, b.Min.Y):]
+		c.comp(0).encodeComp(pix, 4, ig.Stride)
+		c.comp(1).encodeComp(pix[1:], 4, ig.Stride)
+		c.comp(2).encodeComp(pix[2:], 4, ig.Stride)
+		c.comp(3).encodeComp(pix[3:], 4, ig.Stride)
 	case C.OPJ_CLRSPC_SYCC:
 		ig := img.(*image.YCbCr)
-		c.comp(0).encodeComp(ig.Y, 1, ig.YStride)
-		c.comp(1).encodeComp(ig.Cb, 1, ig.CStride)
-		c.comp(2).encodeComp(ig.Cr, 1, ig.CStride)
+		cb, cr, cs := util.AlignedChroma(ig)
+		c.comp(0).encodeComp(ig.Y[ig.YOffset(b.Min.X, b.Min.Y):], 1, ig.YStride)
+		c.comp(1).encodeComp(cb, 1, cs)
+		c.comp(2).encodeComp(cr, 1, cs)
 	}
 	var par C.opj_cparameters_t
 	c.codec = C.opj_create_compress(C.OPJ_CODEC_JP2)
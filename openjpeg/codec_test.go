@@ -1,8 +1,12 @@
 package openjpeg
 
 import (
+	"github.com/ezdiy/image/util"
+	"image"
+	"image/color"
 	"image/jpeg"
 	"image/png"
+	"io/ioutil"
 	"log"
 	"os"
 	"testing"
@@ -35,3 +39,54 @@ func TestEncode(t *testing.T) {
 	})
 	log.Println(c.err)
 }
+
+// Sub-images starting mid-sample keep chroma with its luma. See the jpeg test of the same.
+// Both chroma planes have the same edges, so that their order doesn't matter here.
+func TestEncodeSubImage(t *testing.T) {
+	yuv := image.NewYCbCr(image.Rect(0, 0, 64, 48), image.YCbCrSubsampleRatio420)
+	for i := range yuv.Y {
+		yuv.Y[i] = 128
+	}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			c := yuv.COffset(x, y)
+			yuv.Cb[c], yuv.Cr[c] = 0, 0
+			if x >= 16 || y >= 16 {
+				yuv.Cb[c], yuv.Cr[c] = 255, 255
+			}
+		}
+	}
+	rect := image.Rect(1, 1, 48, 40)
+	si := util.Crop(yuv, &rect).(*image.YCbCr)
+	f, err := ioutil.TempFile("", "subimage*.jp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := Encode(f, si, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bounds().Size() != rect.Size() {
+		t.Fatalf("got %v, want %v", out.Bounds(), rect.Size())
+	}
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			w := si.YCbCrAt(rect.Min.X+x, rect.Min.Y+y)
+			g := color.YCbCrModel.Convert(out.At(x, y)).(color.YCbCr)
+			if d := int(w.Cb) - int(g.Cb); d < -136 || d > 136 {
+				t.Fatalf("Cb of pixel %d,%d is %d, want %d", x, y, g.Cb, w.Cb)
+			}
+			if d := int(w.Cr) - int(g.Cr); d < -136 || d > 136 {
+				t.Fatalf("Cr of pixel %d,%d is %d, want %d", x, y, g.Cr, w.Cr)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrNotJPEG = errors.New("not a JPEG file")
+
+// Segment of a JPEG file, such as APPn or COM.
+type Segment struct {
+	Marker byte   // Marker code, without the 0xff prefix
+	Data   []byte // Payload, without the length
+}
+
+// Read segments of JPEG header, up to (but not including) the first SOS.
+// Standalone markers are skipped. Reading stops early if fn returns false.
+func ReadSegments(r io.Reader, fn func(s Segment) bool) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return ErrNotJPEG
+	}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != 0xff {
+			return ErrNotJPEG
+		}
+		// Fill bytes
+		for c == 0xff {
+			if c, err = br.ReadByte(); err != nil {
+				return err
+			}
+		}
+		// Standalone markers, or start of image data where the header stops.
+		switch {
+		case c == 0x01 || (c >= 0xd0 && c <= 0xd7):
+			continue
+		case c == 0xda || c == 0xd9:
+			return nil
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(br, l[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(l[:])) - 2
+		if n < 0 {
+			return ErrNotJPEG
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+		if !fn(Segment{c, data}) {
+			return nil
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"math/rand"
 )
 
 // Create a new Image of specified color model.
@@ -110,6 +109,46 @@ func SSR2VHDiv(i image.YCbCrSubsampleRatio) (v, h int) {
 	return int(yvh[i] >> 4), int(yvh[i] & 15)
 }
 
+// Chroma planes of im from its origin, each sample covering the luma pixels it's
+// encoded with. Sub-images starting mid-sample, as Crop makes them, get their
+// chroma resampled, others are returned in place.
+func AlignedChroma(im *image.YCbCr) (cb, cr []byte, stride int) {
+	v, h := SSR2VHDiv(im.SubsampleRatio)
+	b := im.Rect
+	if b.Min.X%h == 0 && b.Min.Y%v == 0 {
+		co := im.COffset(b.Min.X, b.Min.Y)
+		return im.Cb[co:], im.Cr[co:], im.CStride
+	}
+	cw, ch := (b.Dx()+h-1)/h, (b.Dy()+v-1)/v
+	cb, cr = make([]byte, cw*ch), make([]byte, cw*ch)
+	for cy := 0; cy < ch; cy++ {
+		y0 := b.Min.Y + cy*v
+		y1 := y0 + v
+		if y1 > b.Max.Y {
+			y1 = b.Max.Y
+		}
+		for cx := 0; cx < cw; cx++ {
+			x0 := b.Min.X + cx*h
+			x1 := x0 + h
+			if x1 > b.Max.X {
+				x1 = b.Max.X
+			}
+			var sb, sr, n int
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					co := im.COffset(x, y)
+					sb += int(im.Cb[co])
+					sr += int(im.Cr[co])
+					n++
+				}
+			}
+			cb[cy*cw+cx] = uint8((sb + n/2) / n)
+			cr[cy*cw+cx] = uint8((sr + n/2) / n)
+		}
+	}
+	return cb, cr, cw
+}
+
 func abs(x int) int {
 	if x < 0 {
 		return -x
@@ -117,6 +156,9 @@ func abs(x int) int {
 	return x
 }
 
+// Check if image is (almost) gray. Fuzz is the largest difference of 8-bit color
+// components still considered gray. Every pixel is examined, as a single colored
+// one makes the image color. If fuzz is -1, any image is gray.
 func IsGray(img image.Image, fuzz int) bool {
 	if _, ok := img.(*image.Gray); ok {
 		return true
@@ -124,13 +166,35 @@ func IsGray(img image.Image, fuzz int) bool {
 	if fuzz == -1 || fuzz > 255 {
 		return true
 	}
-	// Otherwise sample few pixels and check if they're gray
-	for i := 0; i < 256; i++ {
-		r,g,b,_ := img.At(rand.Intn(img.Bounds().Dx()), rand.Intn(img.Bounds().Dy())).RGBA()
-		rg := abs(int(r-g))
-		rb := abs(int(r-b))
-		if abs(rg-rb) > fuzz {
-			return false
+	gray := func(r, g, b int) bool {
+		return abs(r-g) <= fuzz && abs(r-b) <= fuzz && abs(g-b) <= fuzz
+	}
+	b := img.Bounds()
+	// Fast: RGB, straight from the pixels
+	var pix []byte
+	var stride int
+	if rgba, ok := img.(*image.RGBA); ok {
+		pix, stride = rgba.Pix, rgba.Stride
+	} else if nrgba, ok := img.(*image.NRGBA); ok {
+		pix, stride = nrgba.Pix, nrgba.Stride
+	}
+	if pix != nil {
+		for y := 0; y < b.Dy(); y++ {
+			row := pix[y*stride:][:b.Dx()*4]
+			for i := 0; i < len(row); i += 4 {
+				if !gray(int(row[i]), int(row[i+1]), int(row[i+2])) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if !gray(int(r>>8), int(g>>8), int(bl>>8)) {
+				return false
+			}
 		}
 	}
 	return true
@@ -0,0 +1,338 @@
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Just enough of a DOM to edit the packet without disturbing the rest of it.
+// Raw tokens are used, so that prefixes stay as they were.
+type node struct {
+	tok      xml.Token // xml.StartElement for elements
+	children []*node
+}
+
+// Well known prefixes, for namespaces not yet declared in the packet.
+var prefixes = map[string]string{
+	NsXMP:                                   "xmp",
+	NsXMPNote:                               "xmpNote",
+	NsDC:                                    "dc",
+	NsRights:                                "xmpRights",
+	"http://ns.adobe.com/xap/1.0/mm/":       "xmpMM",
+	"http://ns.adobe.com/photoshop/1.0/":    "photoshop",
+	"http://ns.adobe.com/tiff/1.0/":         "tiff",
+	"http://ns.adobe.com/exif/1.0/":         "exif",
+	"http://ns.adobe.com/hdr-gain-map/1.0/": "hdrgm",
+}
+
+type doc struct {
+	root *node
+	ns   map[string]string // prefix -> uri, of all declarations in the document
+	decl []string          // prefixes in order of declaration
+}
+
+func parse(b []byte) (*doc, error) {
+	d := &doc{root: &node{}, ns: map[string]string{"xml": "http://www.w3.org/XML/1998/namespace"}}
+	stack := []*node{d.root}
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := dec.RawToken()
+		if err != nil {
+			if len(stack) != 1 {
+				return nil, fmt.Errorf("xmp: %v", err)
+			}
+			return d, nil
+		}
+		top := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					d.declare(a.Name.Local, a.Value)
+				}
+			}
+			n := &node{tok: t.Copy()}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 1 {
+				return nil, errors.New("xmp: unbalanced XML")
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			top.children = append(top.children, &node{tok: xml.CopyToken(t)})
+		}
+	}
+}
+
+func qname(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// Unlike xml.EscapeText, these leave whitespace alone, keeping the layout.
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+func (n *node) write(w *bytes.Buffer) {
+	switch t := n.tok.(type) {
+	case nil:
+	case xml.StartElement:
+		w.WriteString("<" + qname(t.Name))
+		for _, a := range t.Attr {
+			w.WriteString(" " + qname(a.Name) + `="` + attrEscaper.Replace(a.Value) + `"`)
+		}
+		if len(n.children) == 0 {
+			w.WriteString("/>")
+			return
+		}
+		w.WriteString(">")
+	case xml.CharData:
+		w.WriteString(textEscaper.Replace(string(t)))
+	case xml.Comment:
+		w.WriteString("<!--" + string(t) + "-->")
+	case xml.ProcInst:
+		w.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+	case xml.Directive:
+		w.WriteString("<!" + string(t) + ">")
+	}
+	for _, c := range n.children {
+		c.write(w)
+	}
+	if t, ok := n.tok.(xml.StartElement); ok {
+		w.WriteString("</" + qname(t.Name) + ">")
+	}
+}
+
+func (d *doc) bytes() []byte {
+	var w bytes.Buffer
+	d.root.write(&w)
+	return w.Bytes()
+}
+
+// Check if the name is ns:local.
+func (d *doc) is(n xml.Name, ns, local string) bool {
+	return n.Local == local && d.ns[n.Space] == ns
+}
+
+// All rdf:Description elements.
+func (d *doc) descriptions() (res []*node) {
+	var walk func(n *node)
+	walk = func(n *node) {
+		if t, ok := n.tok.(xml.StartElement); ok && d.is(t.Name, NsRDF, "Description") {
+			res = append(res, n)
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(d.root)
+	return
+}
+
+// Text content of the element.
+func (n *node) text() (s string) {
+	for _, c := range n.children {
+		if cd, ok := c.tok.(xml.CharData); ok {
+			s += string(cd)
+		}
+	}
+	return
+}
+
+// For properties which are rdf:Alt, rdf:Seq or rdf:Bag, the first rdf:li.
+// Otherwise the element itself.
+func (d *doc) valueNode(n *node) *node {
+	for _, c := range n.children {
+		if t, ok := c.tok.(xml.StartElement); ok {
+			if !d.is(t.Name, NsRDF, "Alt") && !d.is(t.Name, NsRDF, "Seq") && !d.is(t.Name, NsRDF, "Bag") {
+				return nil // Structure, can't handle that
+			}
+			for _, li := range c.children {
+				if t, ok := li.tok.(xml.StartElement); ok && d.is(t.Name, NsRDF, "li") {
+					return li
+				}
+			}
+			return nil
+		}
+	}
+	return n
+}
+
+// Calls fn for each occurence of the property, either attribute of rdf:Description
+// (attr >= 0), or its child element.
+func (d *doc) find(ns, name string, fn func(desc *node, attr int, elem int) bool) {
+	for _, desc := range d.descriptions() {
+		t := desc.tok.(xml.StartElement)
+		for i, a := range t.Attr {
+			if d.is(a.Name, ns, name) && !fn(desc, i, -1) {
+				return
+			}
+		}
+		for i, c := range desc.children {
+			if t, ok := c.tok.(xml.StartElement); ok && d.is(t.Name, ns, name) && !fn(desc, -1, i) {
+				return
+			}
+		}
+	}
+}
+
+func (d *doc) get(ns, name string) (val string, found bool) {
+	d.find(ns, name, func(desc *node, attr, elem int) bool {
+		if attr >= 0 {
+			val, found = desc.tok.(xml.StartElement).Attr[attr].Value, true
+			return false
+		}
+		el := desc.children[elem]
+		for _, a := range el.tok.(xml.StartElement).Attr {
+			if d.is(a.Name, NsRDF, "resource") {
+				val, found = a.Value, true
+				return false
+			}
+		}
+		if v := d.valueNode(el); v != nil {
+			val, found = v.text(), true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Get value of simple property, or the first item of an array property.
+// Extended part is searched too.
+func (p *Packet) Get(ns, name string) (string, bool) {
+	for _, b := range [][]byte{p.XML, p.Extended} {
+		if d, err := parse(b); err == nil && b != nil {
+			if v, ok := d.get(ns, name); ok {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Set value of simple property in the main packet, or the first item of an array
+// property. New properties are added as attributes of the first rdf:Description.
+func (p *Packet) Set(ns, name, value string) error {
+	d, err := parse(p.XML)
+	if err != nil {
+		return err
+	}
+	set := false
+	d.find(ns, name, func(desc *node, attr, elem int) bool {
+		if attr >= 0 {
+			desc.tok.(xml.StartElement).Attr[attr].Value = value
+			set = true
+		} else if v := d.valueNode(desc.children[elem]); v != nil {
+			v.children = []*node{{tok: xml.CharData(value)}}
+			set = true
+		}
+		return !set
+	})
+	if !set {
+		descs := d.descriptions()
+		if len(descs) == 0 {
+			return errors.New("xmp: no rdf:Description to add property to")
+		}
+		desc := descs[0]
+		t := desc.tok.(xml.StartElement)
+		prefix := d.prefix(ns)
+		if prefix == "" {
+			prefix = prefixes[ns]
+			for i := 1; prefix == "" || d.ns[prefix] != ""; i++ {
+				prefix = fmt.Sprintf("ns%d", i)
+			}
+			t.Attr = append(t.Attr, xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: ns})
+			d.declare(prefix, ns)
+		}
+		t.Attr = append(t.Attr, xml.Attr{Name: xml.Name{Space: prefix, Local: name}, Value: value})
+		desc.tok = t
+	}
+	p.XML = d.bytes()
+	return nil
+}
+
+// Remove property from the main packet. Returns false if there was none.
+func (p *Packet) Delete(ns, name string) (found bool) {
+	found, _ = p.delete(ns, name)
+	return
+}
+
+func (p *Packet) delete(ns, name string) (found bool, err error) {
+	d, err := parse(p.XML)
+	if err != nil {
+		return false, err
+	}
+	d.find(ns, name, func(desc *node, attr, elem int) bool {
+		if attr >= 0 {
+			t := desc.tok.(xml.StartElement)
+			t.Attr = append(t.Attr[:attr], t.Attr[attr+1:]...)
+			desc.tok = t
+		} else {
+			desc.children = append(desc.children[:elem], desc.children[elem+1:]...)
+		}
+		found = true
+		return false
+	})
+	if found {
+		p.XML = d.bytes()
+	}
+	return
+}
+
+// Record namespace declaration.
+func (d *doc) declare(prefix, ns string) {
+	if _, ok := d.ns[prefix]; !ok {
+		d.decl = append(d.decl, prefix)
+	}
+	d.ns[prefix] = ns
+}
+
+// Find prefix declared for namespace, the first one if there are more.
+func (d *doc) prefix(ns string) string {
+	for _, p := range d.decl {
+		if d.ns[p] == ns && p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// Add raw rdf:Description element to the main packet, for structures and arrays Set
+// can't express. Namespaces it uses must be declared on the element itself, unless
+// the packet already declares them with the same prefixes.
+func (p *Packet) AddDescription(desc string) error {
+	d, err := parse(p.XML)
+	if err != nil {
+		return err
+	}
+	nd, err := parse([]byte(desc))
+	if err != nil {
+		return err
+	}
+	var rdf *node
+	var walk func(n *node)
+	walk = func(n *node) {
+		if t, ok := n.tok.(xml.StartElement); ok && rdf == nil && d.is(t.Name, NsRDF, "RDF") {
+			rdf = n
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(d.root)
+	if rdf == nil {
+		return errors.New("xmp: no rdf:RDF to add description to")
+	}
+	rdf.children = append(rdf.children, nd.root.children...)
+	p.XML = d.bytes()
+	return nil
+}
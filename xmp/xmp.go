@@ -0,0 +1,174 @@
+// Package xmp extracts and embeds XMP metadata packets of JPEG files, including
+// the multi-segment Extended XMP used when the packet doesn't fit a single APP1.
+//
+// The packet is kept as raw XML. Get, Set and Delete offer minimal access to simple
+// properties, anything more elaborate needs a real XML/RDF library.
+package xmp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/ezdiy/image/util"
+	"io"
+	"strings"
+)
+
+var (
+	// APP1 headers of standard and extended packets.
+	Header         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	ExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+	ErrNotFound = errors.New("xmp: no XMP data")
+	ErrTooLarge = errors.New("xmp: packet doesn't fit APP1 segment, move properties to Extended")
+	ErrExtended = errors.New("xmp: extended XMP missing or corrupted")
+)
+
+const (
+	NsRDF     = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	NsXMP     = "http://ns.adobe.com/xap/1.0/"
+	NsXMPNote = "http://ns.adobe.com/xmp/note/"
+	NsDC      = "http://purl.org/dc/elements/1.1/"
+	NsRights  = "http://ns.adobe.com/xap/1.0/rights/"
+
+	// Segment payload limits.
+	maxSegment  = 0xffff - 2
+	guidLen     = 32
+	maxPacket   = maxSegment - 29 // len(Header)
+	maxExtChunk = maxSegment - 35 - guidLen - 8
+)
+
+// Packet holds the XMP data.
+type Packet struct {
+	XML      []byte // Main packet
+	Extended []byte // Extended part, if any. It's a complete x:xmpmeta document too.
+}
+
+// Create a packet with empty rdf:Description, ready for Set.
+func New() *Packet {
+	return &Packet{XML: []byte("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="` + NsRDF + `">` +
+		`<rdf:Description rdf:about=""/></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)}
+}
+
+// Decode XMP from APP1 segment payloads, as found in the file. Payloads of other APP1
+// segments (EXIF) are ignored. If the extended part is referenced, but can't be
+// reassembled, the main packet is returned along with ErrExtended.
+func Decode(app1 [][]byte) (p *Packet, err error) {
+	for _, b := range app1 {
+		if bytes.HasPrefix(b, Header) {
+			p = &Packet{XML: append([]byte(nil), b[len(Header):]...)}
+			break
+		}
+	}
+	if p == nil {
+		return nil, ErrNotFound
+	}
+	guid, ok := p.Get(NsXMPNote, "HasExtendedXMP")
+	if !ok {
+		return p, nil
+	}
+
+	// Chunks can come in any order, and each carries the full length. It's trusted
+	// with allocation only if the chunks add up to it.
+	var chunks [][]byte
+	size := 0
+	for _, b := range app1 {
+		if !bytes.HasPrefix(b, ExtendedHeader) {
+			continue
+		}
+		b = b[len(ExtendedHeader):]
+		if len(b) < guidLen+8 || string(b[:guidLen]) != guid {
+			continue
+		}
+		chunks = append(chunks, b)
+		size += len(b) - guidLen - 8
+	}
+	var ext []byte
+	var got int
+	for _, b := range chunks {
+		total := binary.BigEndian.Uint32(b[guidLen:])
+		off := binary.BigEndian.Uint32(b[guidLen+4:])
+		data := b[guidLen+8:]
+		if ext == nil {
+			if uint64(total) > uint64(size) {
+				return p, ErrExtended
+			}
+			ext = make([]byte, total)
+		}
+		if uint32(len(ext)) != total || uint64(off)+uint64(len(data)) > uint64(total) {
+			return p, ErrExtended
+		}
+		got += copy(ext[off:], data)
+	}
+	if ext == nil || got != len(ext) || guidOf(ext) != guid {
+		return p, ErrExtended
+	}
+	p.Extended = ext
+	return p, nil
+}
+
+// GUID of extended XMP is the MD5 of its content.
+func guidOf(ext []byte) string {
+	sum := md5.Sum(ext)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Encode into APP1 segment payloads, main packet first. If there is an extended
+// part, main packet gets updated with its GUID. On error, p is left as it was.
+func (p *Packet) Encode() (app1 [][]byte, err error) {
+	q := *p
+	guid := ""
+	if p.Extended != nil {
+		guid = guidOf(p.Extended)
+		if err = q.Set(NsXMPNote, "HasExtendedXMP", guid); err != nil {
+			return
+		}
+	} else if _, err = q.delete(NsXMPNote, "HasExtendedXMP"); err != nil {
+		return
+	}
+	if len(q.XML) > maxPacket {
+		return nil, ErrTooLarge
+	}
+	p.XML = q.XML
+	app1 = [][]byte{append(append([]byte(nil), Header...), p.XML...)}
+	if p.Extended != nil {
+		app1 = append(app1, p.extended(guid)...)
+	}
+	return
+}
+
+// Split extended part into chunks.
+func (p *Packet) extended(guid string) (res [][]byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p.Extended)))
+	for off := 0; off < len(p.Extended); off += maxExtChunk {
+		chunk := p.Extended[off:]
+		if len(chunk) > maxExtChunk {
+			chunk = chunk[:maxExtChunk]
+		}
+		binary.BigEndian.PutUint32(hdr[4:], uint32(off))
+		b := append([]byte(nil), ExtendedHeader...)
+		b = append(b, guid...)
+		b = append(b, hdr[:]...)
+		res = append(res, append(b, chunk...))
+	}
+	return
+}
+
+// Extract XMP from a JPEG stream. Reads the stream only up to image data.
+func ReadJPEG(r io.Reader) (*Packet, error) {
+	var app1 [][]byte
+	err := util.ReadSegments(r, func(s util.Segment) bool {
+		if s.Marker == 0xe1 {
+			app1 = append(app1, s.Data)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Decode(app1)
+}
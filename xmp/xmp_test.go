@@ -0,0 +1,191 @@
+package xmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestProperties(t *testing.T) {
+	p := New()
+	if _, ok := p.Get(NsDC, "creator"); ok {
+		t.Fatal("unexpected property")
+	}
+	if err := p.Set(NsXMP, "Rating", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set(NsXMP, "Rating", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set("http://example.com/ns/", "Note", `a "quoted" <note> & more`); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := p.Get(NsXMP, "Rating"); !ok || v != "5" {
+		t.Fatalf("rating %q", v)
+	}
+	if v, _ := p.Get("http://example.com/ns/", "Note"); v != `a "quoted" <note> & more` {
+		t.Fatalf("note %q", v)
+	}
+	if !p.Delete(NsXMP, "Rating") || p.Delete(NsXMP, "Rating") {
+		t.Fatal("delete")
+	}
+	if _, ok := p.Get(NsXMP, "Rating"); ok {
+		t.Fatal("not deleted")
+	}
+	err := p.AddDescription(`<rdf:Description xmlns:rdf="` + NsRDF + `" xmlns:dc="` + NsDC + `">` +
+		`<dc:subject><rdf:Bag><rdf:li>one</rdf:li><rdf:li>two</rdf:li></rdf:Bag></dc:subject></rdf:Description>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.Get(NsDC, "subject"); v != "one" {
+		t.Fatalf("subject %q", v)
+	}
+
+	// Element forms, with the prefixes chosen by someone else.
+	p = &Packet{XML: []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <r:RDF xmlns:r="` + NsRDF + `">
+  <r:Description r:about="" xmlns:d="` + NsDC + `" xmlns:a="` + NsXMP + `">
+   <d:title><r:Alt><r:li xml:lang="x-default">Title</r:li></r:Alt></d:title>
+   <a:Label>Red</a:Label>
+  </r:Description>
+ </r:RDF>
+</x:xmpmeta>`)}
+	if v, _ := p.Get(NsDC, "title"); v != "Title" {
+		t.Fatalf("title %q", v)
+	}
+	if err := p.Set(NsDC, "title", "New title"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set(NsXMP, "Label", "Green"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.Get(NsDC, "title"); v != "New title" {
+		t.Fatalf("title %q", v)
+	}
+	if v, _ := p.Get(NsXMP, "Label"); v != "Green" {
+		t.Fatalf("label %q", v)
+	}
+	if !bytes.Contains(p.XML, []byte(`<r:li xml:lang="x-default">New title</r:li>`)) || !bytes.Contains(p.XML, []byte("\n   <a:Label>")) {
+		t.Fatalf("layout not preserved:\n%s", p.XML)
+	}
+}
+
+// Namespace declared twice gets the first prefix.
+func TestPrefix(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		p := &Packet{XML: []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="` + NsRDF + `">` +
+			`<rdf:Description rdf:about="" xmlns:zz="` + NsXMP + `" xmlns:aa="` + NsXMP + `" xmlns:mm="` + NsXMP + `"/>` +
+			`</rdf:RDF></x:xmpmeta>`)}
+		if err := p.Set(NsXMP, "Rating", "2"); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(p.XML, []byte(`zz:Rating="2"`)) {
+			t.Fatalf("prefix not first declared:\n%s", p.XML)
+		}
+	}
+}
+
+func TestExtended(t *testing.T) {
+	p := New()
+	if err := p.Set(NsXMP, "Rating", "1"); err != nil {
+		t.Fatal(err)
+	}
+	big := New()
+	if err := big.Set(NsDC, "description", strings.Repeat("0123456789", 20000)); err != nil {
+		t.Fatal(err)
+	}
+	p.Extended = big.XML
+	app1, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(app1) < 5 {
+		t.Fatalf("%d segments", len(app1))
+	}
+	for _, b := range app1 {
+		if len(b) > maxSegment {
+			t.Fatalf("segment of %d bytes", len(b))
+		}
+	}
+
+	// Chunks may come in any order.
+	shuffled := append([][]byte{app1[0]}, app1[len(app1)-1])
+	shuffled = append(shuffled, app1[1:len(app1)-1]...)
+	p2, err := Decode(shuffled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p2.XML, p.XML) || !bytes.Equal(p2.Extended, p.Extended) {
+		t.Fatal("roundtrip mismatch")
+	}
+	if v, _ := p2.Get(NsDC, "description"); len(v) != 200000 {
+		t.Fatalf("description of %d bytes", len(v))
+	}
+
+	// Missing or corrupted chunk.
+	if _, err := Decode(app1[:len(app1)-1]); err != ErrExtended {
+		t.Fatalf("expected ErrExtended, got %v", err)
+	}
+	huge := append([]byte(nil), app1[1]...)
+	binary.BigEndian.PutUint32(huge[len(ExtendedHeader)+guidLen:], 0xfffffff0)
+	if _, err := Decode([][]byte{app1[0], huge}); err != ErrExtended {
+		t.Fatalf("expected ErrExtended, got %v", err)
+	}
+	app1[2] = append([]byte(nil), app1[2]...)
+	app1[2][len(app1[2])-1] ^= 1
+	if p3, err := Decode(app1); err != ErrExtended || p3 == nil {
+		t.Fatalf("expected ErrExtended, got %v", err)
+	}
+
+	// Dropping the extended part clears the reference.
+	p.Extended = nil
+	if app1, err = p.Encode(); err != nil || len(app1) != 1 {
+		t.Fatal(err, len(app1))
+	}
+	if _, ok := p.Get(NsXMPNote, "HasExtendedXMP"); ok {
+		t.Fatal("stale HasExtendedXMP")
+	}
+
+	p.XML = append(p.XML, make([]byte, maxSegment)...)
+	if _, err := p.Encode(); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	// Failed encoding leaves the packet alone.
+	p = &Packet{XML: append([]byte(nil), big.XML...), Extended: p.XML}
+	if _, err := p.Encode(); err != ErrTooLarge || !bytes.Equal(p.XML, big.XML) {
+		t.Fatalf("packet changed, %v", err)
+	}
+	p = &Packet{XML: []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">`)}
+	if _, err := p.Encode(); err == nil {
+		t.Fatal("encoded malformed packet")
+	}
+}
+
+func TestReadJPEG(t *testing.T) {
+	p := New()
+	if err := p.Set(NsXMP, "CreatorTool", "test"); err != nil {
+		t.Fatal(err)
+	}
+	app1, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := []byte{0xff, 0xd8}
+	for _, b := range append([][]byte{[]byte("Exif\x00\x00II*\x00")}, app1...) {
+		f = append(f, 0xff, 0xe1, byte((len(b)+2)>>8), byte(len(b)+2))
+		f = append(f, b...)
+	}
+	f = append(f, 0xff, 0xda, 0, 3, 0)
+	p2, err := ReadJPEG(bytes.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p2.Get(NsXMP, "CreatorTool"); v != "test" {
+		t.Fatalf("creator tool %q", v)
+	}
+	if _, err := ReadJPEG(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xd9})); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}